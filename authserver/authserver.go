@@ -8,18 +8,43 @@
 // two endpoints /get and /set. The former allows a caller to fetch the name of
 // a user given a UUID, and the later allows setting a user in the data store
 // given a UUID and name. For purposes of this assignment both endpoints are
-// are implemented as HTTP GETs with data passed via query parameter.
+// are implemented as HTTP GETs with data passed via query parameter. User
+// preferences are read and written in the same manner through /prefs and
+// /setprefs, with /prefs returning a JSON document.
+// Operational metrics and readiness are exposed at /metrics and /readyz,
+// optionally on a separate admin port given by --authadmin-port. Liveness
+// is exposed at /healthz on both ports. Given --auth-cert, --auth-key and
+// --auth-ca the main port is served over TLS and /set and /setprefs only
+// accept callers presenting a certificate signed by the CA. Certificates are
+// reloaded when their files change. Given --service-keys, the user endpoints
+// only serve requests signed by a key in that file. Given --replicate-from,
+// authserver follows that primary: it copies the primary's users, keeps up with
+// its changes, serves reads and refuses writes until promoted with a POST to
+// /promote on the admin port.
 
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	log "github.com/cihub/seelog"
 	"github.com/gorilla/mux"
+	"github.com/patkaehuaea/command/authserver/client"
 	"github.com/patkaehuaea/command/authserver/people"
+	"github.com/patkaehuaea/command/authserver/replica"
+	"github.com/patkaehuaea/command/authserver/token"
+	"github.com/patkaehuaea/command/certs"
 	"github.com/patkaehuaea/command/config"
+	"github.com/patkaehuaea/command/health"
+	"github.com/patkaehuaea/command/stats"
+	"github.com/patkaehuaea/command/timefmt"
 	"io"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -28,7 +53,34 @@ const (
 	SEELOG_CONF_FILE = "seelog.xml"
 )
 
-var users *people.UserStore
+var (
+	checkpointLatency *stats.Histogram
+	checkpoints       *stats.CounterVec
+	keys              *token.Keyring
+	liveness          *health.Checker
+	readiness         *health.Checker
+	registry          *stats.Registry
+	replLog           *replica.Log
+	requests          *stats.CounterVec
+	users             *people.UserStore
+)
+
+// Outcome of the initial Load() and most recent checkpoint,
+// reported by the readiness endpoint.
+var state struct {
+	sync.RWMutex
+	loadErr        error
+	checkpointErr  error
+	checkpointAt   time.Time
+	checkpointDone bool
+}
+
+// Follower keeping users up to date with --replicate-from, nil when
+// primary or once promoted.
+var role struct {
+	sync.RWMutex
+	follower *replica.Follower
+}
 
 func handleGetUser(w http.ResponseWriter, r *http.Request) {
 	log.Info("authserver: Get user handler called.")
@@ -37,9 +89,11 @@ func handleGetUser(w http.ResponseWriter, r *http.Request) {
 		log.Debug("authserver: Found valid uuid: " + uuid)
 		w.WriteHeader(http.StatusOK)
 		io.WriteString(w, users.Name(uuid))
+		requests.With("get", strconv.Itoa(http.StatusOK)).Inc()
 	} else {
 		log.Debug("authserver: UUID not valid, or not found in users.")
 		w.WriteHeader(http.StatusBadRequest)
+		requests.With("get", strconv.Itoa(http.StatusBadRequest)).Inc()
 	}
 }
 
@@ -52,18 +106,225 @@ func handleSetUser(w http.ResponseWriter, r *http.Request) {
 	if people.IsValidUUID(uuid) && people.IsValidName(name) {
 		users.Add(uuid, name)
 		w.WriteHeader(http.StatusOK)
+		requests.With("set", strconv.Itoa(http.StatusOK)).Inc()
 	} else {
 		log.Debug("authserver: Invalid uuid and/or name.")
 		w.WriteHeader(http.StatusBadRequest)
+		requests.With("set", strconv.Itoa(http.StatusBadRequest)).Inc()
 	}
 }
 
+func handleGetPrefs(w http.ResponseWriter, r *http.Request) {
+	log.Info("authserver: Get prefs handler called.")
+
+	uuid := r.FormValue("cookie")
+	if !people.IsValidUUID(uuid) {
+		log.Debug("authserver: UUID not valid.")
+		w.WriteHeader(http.StatusBadRequest)
+		requests.With("prefs", strconv.Itoa(http.StatusBadRequest)).Inc()
+		return
+	}
+
+	prefs, ok := users.Prefs(uuid)
+	if !ok {
+		log.Debug("authserver: UUID not found in users.")
+		w.WriteHeader(http.StatusNotFound)
+		requests.With("prefs", strconv.Itoa(http.StatusNotFound)).Inc()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(prefs); err != nil {
+		log.Error(err)
+	}
+	requests.With("prefs", strconv.Itoa(http.StatusOK)).Inc()
+}
+
+// Replaces every preference of the user. Parameters absent from the
+// request clear the corresponding preference.
+func handleSetPrefs(w http.ResponseWriter, r *http.Request) {
+	log.Info("authserver: Set prefs handler called.")
+
+	uuid := r.FormValue("cookie")
+	prefs := people.Prefs{
+		TZ:     r.FormValue("tz"),
+		Format: r.FormValue("format"),
+		Locale: r.FormValue("locale"),
+		Zones:  people.SplitZones(r.FormValue("zones")),
+	}
+
+	valid := people.IsValidTZ(prefs.TZ) && timefmt.IsValid(prefs.Format) &&
+		timefmt.IsSupported(prefs.Locale) && people.IsValidZones(prefs.Zones)
+	if !people.IsValidUUID(uuid) || !valid {
+		log.Debug("authserver: Invalid uuid and/or prefs.")
+		w.WriteHeader(http.StatusBadRequest)
+		requests.With("setprefs", strconv.Itoa(http.StatusBadRequest)).Inc()
+		return
+	}
+
+	if !users.SetPrefs(uuid, prefs) {
+		log.Debug("authserver: UUID not found in users.")
+		w.WriteHeader(http.StatusNotFound)
+		requests.With("setprefs", strconv.Itoa(http.StatusNotFound)).Inc()
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	requests.With("setprefs", strconv.Itoa(http.StatusOK)).Inc()
+}
+
+// Wraps handler for op so that, when served over TLS, only callers
+// with a verified client certificate may use it.
+func requireClientCert(op string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && !certs.Verified(r.TLS) {
+			log.Warn("authserver: " + op + " refused, no client certificate.")
+			w.WriteHeader(http.StatusForbidden)
+			requests.With(op, strconv.Itoa(http.StatusForbidden)).Inc()
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// Wraps handler for op so that, when --service-keys is set, only
+// requests signed by one of the keys are served.
+func requireToken(op string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if keys == nil {
+			fn(w, r)
+			return
+		}
+		if err := keys.Verify(r); err != nil {
+			log.Warn("authserver: "+op+" refused from "+r.RemoteAddr+": ", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			requests.With(op, strconv.Itoa(http.StatusUnauthorized)).Inc()
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// Wraps handler for op so that followers refuse it, telling the
+// caller to try the primary.
+func requirePrimary(op string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role.RLock()
+		following := role.follower != nil
+		role.RUnlock()
+		if following {
+			log.Debug("authserver: " + op + " refused, following primary.")
+			w.Header().Set(client.ROLE_HEADER, client.ROLE_FOLLOWER)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			requests.With(op, strconv.Itoa(http.StatusServiceUnavailable)).Inc()
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// Stops following the primary and accepts writes from then on.
+func handlePromote(w http.ResponseWriter, r *http.Request) {
+	log.Info("authserver: Promote handler called.")
+
+	role.Lock()
+	defer role.Unlock()
+	if role.follower == nil {
+		w.WriteHeader(http.StatusConflict)
+		io.WriteString(w, "already primary\n")
+		return
+	}
+	role.follower.Stop()
+	role.follower = nil
+	seq := strconv.FormatUint(users.Seq(), 10)
+	log.Warn("authserver: Promoted to primary at " + seq + ".")
+	io.WriteString(w, "promoted at "+seq+"\n")
+}
+
 func handleNotFound(w http.ResponseWriter, r *http.Request) {
 	log.Info("authserver: Not found handler called.")
 	w.WriteHeader(http.StatusNotFound)
 }
 
-func init() {
+// Records outcome of each checkpoint taken by UserStore.Persist().
+func observeCheckpoint(elapsed time.Duration, err error) {
+	state.Lock()
+	state.checkpointErr = err
+	state.checkpointAt = time.Now()
+	state.checkpointDone = true
+	state.Unlock()
+
+	checkpointLatency.Observe(elapsed)
+	if err != nil {
+		checkpoints.With("failure").Inc()
+		return
+	}
+	checkpoints.With("success").Inc()
+}
+
+// Readiness check reporting whether users were loaded from the
+// dumpfile. A missing dumpfile is expected on first run.
+func checkLoad() (detail string, err error) {
+	state.RLock()
+	err = state.loadErr
+	state.RUnlock()
+	detail = *config.DumpFile
+	return
+}
+
+// Readiness check reporting whether the most recent checkpoint
+// succeeded. Fails until the first checkpoint completes.
+func checkCheckpoint() (detail string, err error) {
+	state.RLock()
+	defer state.RUnlock()
+	if !state.checkpointDone {
+		err = errors.New("authserver: No checkpoint completed yet.")
+		return
+	}
+	detail = "last checkpoint at " + state.checkpointAt.Format(time.RFC3339)
+	err = state.checkpointErr
+	return
+}
+
+// Readiness check reporting role and, for followers, whether a
+// snapshot has been loaded and the primary heard from recently.
+func checkReplication() (detail string, err error) {
+	role.RLock()
+	follower := role.follower
+	role.RUnlock()
+	seq := strconv.FormatUint(users.Seq(), 10)
+	if follower == nil {
+		detail = "primary at " + seq + ", " + strconv.Itoa(replLog.Followers()) + " followers"
+		return
+	}
+
+	lag, since := follower.Lag()
+	detail = "following " + *config.ReplicateFrom + " at " + seq + ", " + strconv.FormatUint(lag, 10) +
+		" behind, heard from " + since.String() + " ago"
+	switch {
+	case !follower.Synced():
+		err = errors.New("authserver: No snapshot loaded from primary yet.")
+	case since > *config.ReplicaMaxLag:
+		err = errors.New("authserver: Primary not heard from within --replica-max-lag.")
+	}
+	return
+}
+
+// Returns replication lag in mutations and seconds, zero if primary.
+func replicationLag() (mutations uint64, seconds float64) {
+	role.RLock()
+	defer role.RUnlock()
+	if role.follower == nil {
+		return
+	}
+	lag, since := role.follower.Lag()
+	return lag, since.Seconds()
+}
+
+// Loads the store and builds replication, health checks and metrics
+// from parsed flags, then starts checkpointing.
+func setup() {
 
 	log.ReplaceLogger(config.Logger)
 
@@ -80,8 +341,56 @@ func init() {
 	// reference a public member.
 	users = people.NewUsers()
 	if err := users.Load(*config.DumpFile); err != nil {
-		log.Info("database: Backup not found at initialization.")
+		if os.IsNotExist(err) {
+			log.Info("database: Backup not found at initialization.")
+		} else {
+			log.Error(err)
+			state.loadErr = err
+		}
 	}
+
+	if *config.ServiceKeys == config.SERVICE_KEYS {
+		log.Warn("authserver: --service-keys not set, any caller may use every endpoint.")
+	} else {
+		var err error
+		if keys, err = token.NewKeyring(*config.ServiceKeys); err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+		go keys.Watch(*config.CertReload, nil)
+	}
+
+	// Followers reset the log to their primary's history once they
+	// have a snapshot.
+	replLog = replica.NewLog(*config.ReplLogSize, users.Seq())
+	users.OnMutation = replLog.Append
+
+	liveness = health.NewChecker(VERSION_NUMBER)
+	readiness = health.NewChecker(VERSION_NUMBER)
+	readiness.Add("load", checkLoad)
+	readiness.Add("checkpoint", checkCheckpoint)
+	readiness.Add("replication", checkReplication)
+
+	checkpointLatency = stats.NewHistogram(stats.DEFAULT_BUCKETS)
+	checkpoints = stats.NewCounterVec("result")
+	requests = stats.NewCounterVec("op", "code")
+	registry = stats.NewRegistry()
+	registry.GaugeFunc("authserver_users", "Number of users in the store.", func() float64 { return float64(users.Count()) })
+	registry.CounterVec("authserver_requests_total", "Requests by operation and status code.", requests)
+	registry.CounterVec("authserver_checkpoints_total", "Checkpoints to dumpfile by result.", checkpoints)
+	registry.Histogram("authserver_checkpoint_duration_seconds", "Time taken to write a checkpoint.", checkpointLatency)
+	registry.GaugeFunc("authserver_replication_seq", "Sequence number of the last change to the store.", func() float64 { return float64(users.Seq()) })
+	registry.GaugeFunc("authserver_replication_followers", "Followers streaming changes from this authserver.", func() float64 { return float64(replLog.Followers()) })
+	registry.GaugeFunc("authserver_replication_lag_mutations", "Changes made on the primary not yet applied here, zero if primary.", func() float64 {
+		lag, _ := replicationLag()
+		return float64(lag)
+	})
+	registry.GaugeFunc("authserver_replication_lag_seconds", "Time since this follower last heard from the primary, zero if primary.", func() float64 {
+		_, seconds := replicationLag()
+		return seconds
+	})
+
+	users.OnCheckpoint = observeCheckpoint
 	go users.Persist(*config.DumpFile, *config.CheckpointInt)
 }
 
@@ -89,18 +398,130 @@ func main() {
 
 	/*
 	   Paramters surfaced via config pacakge used in this program:
+	   *config.AuthAdminPort
+	   *config.AuthCA
+	   *config.AuthCert
+	   *config.AuthKey
 	   *config.AuthPort
+	   *config.AuthProtocol
+	   *config.CertReload
+	   *config.ReplicaMaxLag
+	   *config.ReplCert
+	   *config.ReplicateFrom
+	   *config.ReplKey
+	   *config.ReplLogSize
+	   *config.ServiceKeys
 	   config.Logger
 	   database.Users
 	*/
 
+	config.Parse()
+	setup()
+
 	r := mux.NewRouter()
-	r.HandleFunc("/get", handleGetUser).Methods("GET")
+	r.HandleFunc("/get", requireToken("get", handleGetUser)).Methods("GET")
 	// Should be POST, but assignment spec requires GET.
-	r.HandleFunc("/set", handleSetUser).Methods("GET")
+	r.HandleFunc("/set", requireToken("set", requireClientCert("set", requirePrimary("set", handleSetUser)))).Methods("GET")
+	r.HandleFunc("/prefs", requireToken("prefs", handleGetPrefs)).Methods("GET")
+	r.HandleFunc("/setprefs", requireToken("setprefs", requireClientCert("setprefs", requirePrimary("setprefs", handleSetPrefs)))).Methods("GET")
+
+	// Any authserver may be followed, including a follower.
+	r.HandleFunc(replica.SNAPSHOT_PATH, requireToken("snapshot", requireClientCert("snapshot", replica.SnapshotHandler(users, replLog)))).Methods("GET")
+	r.HandleFunc(replica.STREAM_PATH, requireToken("stream", requireClientCert("stream", replLog.ServeHTTP))).Methods("GET")
 	r.NotFoundHandler = http.HandlerFunc(handleNotFound)
+
+	// Admin endpoints share the main router unless a separate
+	// port is configured.
+	admin := r
+	if *config.AuthAdminPort != config.ADMIN_PORT {
+		admin = mux.NewRouter()
+		go func() {
+			if err := http.ListenAndServe(*config.AuthAdminPort, admin); err != nil {
+				log.Critical(err)
+				os.Exit(1)
+			}
+		}()
+	}
+	admin.Handle("/metrics", registry).Methods("GET")
+	admin.Handle("/readyz", readiness).Methods("GET")
+
+	// Promoting a follower alongside its primary splits the users in
+	// two, so only operators reaching the admin port may do so.
+	if admin != r {
+		admin.HandleFunc("/promote", handlePromote).Methods("POST")
+	} else if *config.ReplicateFrom != config.REPLICATE_FROM {
+		log.Warn("authserver: --authadmin-port not set, follower can't be promoted.")
+	}
+
+	// Liveness is always served on the main port as AuthClient.Ping()
+	// uses it to determine whether authserver is reachable.
+	r.Handle("/healthz", liveness).Methods("GET")
+	if admin != r {
+		admin.Handle("/healthz", liveness).Methods("GET")
+	}
+
+	// Accepts HTTP/2 without TLS when timeserver is configured for
+	// h2c; HTTP/1.1 remains available either way.
+	protocols, err := client.Protocols(*config.AuthProtocol)
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+	var reloader *certs.Reloader
+	if *config.AuthCert != config.AUTH_CERT {
+		// Without a CA no caller could be verified for /set.
+		if *config.AuthCA == config.AUTH_CA {
+			log.Critical("authserver: --auth-ca is required with --auth-cert.")
+			os.Exit(1)
+		}
+		if reloader, err = certs.NewReloader(*config.AuthCert, *config.AuthKey, *config.AuthCA); err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+		go reloader.Watch(*config.CertReload, nil)
+	}
+
+	if *config.ReplicateFrom != config.REPLICATE_FROM {
+		// A primary serving TLS only streams to followers with a
+		// client certificate, which server certificates usually
+		// can't be used as.
+		opts := client.DefaultTransportOptions()
+		opts.Protocol = *config.AuthProtocol
+		if strings.HasPrefix(*config.ReplicateFrom, "https:") {
+			if *config.ReplCert == config.REPL_CERT {
+				log.Critical("authserver: --replication-cert is required to follow an https primary.")
+				os.Exit(1)
+			}
+			replCerts, err := certs.NewReloader(*config.ReplCert, *config.ReplKey, *config.AuthCA)
+			if err != nil {
+				log.Critical(err)
+				os.Exit(1)
+			}
+			go replCerts.Watch(*config.CertReload, nil)
+			opts.TLSConfig = replCerts.ClientConfig()
+		}
+		transport, err := client.NewTransport(opts)
+		if err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+		follower := replica.NewFollower(*config.ReplicateFrom, users, replLog, &http.Client{Transport: transport})
+		follower.Keys = keys
+		role.Lock()
+		role.follower = follower
+		role.Unlock()
+		go follower.Run()
+	}
+
 	http.Handle("/", r)
-	if err := (http.ListenAndServe(*config.AuthPort, nil)); err != nil {
+	server := &http.Server{Addr: *config.AuthPort, Protocols: protocols}
+	if reloader == nil {
+		err = server.ListenAndServe()
+	} else {
+		server.TLSConfig = reloader.ServerConfig(false)
+		err = server.ListenAndServeTLS("", "")
+	}
+	if err != nil {
 		log.Critical(err)
 	}
 }
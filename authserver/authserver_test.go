@@ -0,0 +1,89 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"github.com/patkaehuaea/command/certs"
+	"github.com/patkaehuaea/command/certs/certstest"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+var dumpFile = filepath.Join(os.TempDir(), "authserver_test_"+strconv.Itoa(os.Getpid())+".json")
+
+// Sets up as main() does; setup() exits without a dumpfile.
+func TestMain(m *testing.M) {
+	flag.Set("dumpfile", dumpFile)
+	setup()
+	code := m.Run()
+	os.Remove(dumpFile)
+	os.Exit(code)
+}
+
+func TestSetRequiresClientCert(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := certstest.NewCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, serverKey, err := ca.Issue("authserver", x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, clientKey, err := ca.Issue("timeserver", x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Served as main() does with --auth-cert and --auth-ca.
+	server, err := certs.NewReloader(serverCert, serverKey, ca.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(requireToken("set", requireClientCert("set", requirePrimary("set", handleSetUser))))
+	srv.Listener = tls.NewListener(srv.Listener, server.ServerConfig(false))
+	srv.Start()
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		certFile string
+		keyFile  string
+		uuid     string
+		want     int
+	}{
+		{"without client certificate", "", "", "0c2d4a1e-8f3b-4c5d-9e6f-7a8b9c0d1e2f", http.StatusForbidden},
+		{"with client certificate", clientCert, clientKey, "1d3e5b2f-9a4c-4d6e-8f7a-8b9c0d1e2f3a", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			caller, err := certs.NewReloader(test.certFile, test.keyFile, ca.File)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &http.Client{Transport: &http.Transport{TLSClientConfig: caller.ClientConfig()}}
+			resp, err := c.Get("https://" + srv.Listener.Addr().String() + "/set?cookie=" + test.uuid + "&name=pat")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, test.want)
+			}
+			stored := users.Name(test.uuid) == "pat"
+			if stored != (test.want == http.StatusOK) {
+				t.Errorf("user stored = %v after status %d", stored, resp.StatusCode)
+			}
+		})
+	}
+}
@@ -7,8 +7,9 @@
 // data store and the file system. Implements functions to Read(), and Write()
 // a JSON encoded document to the file system along with Exists() and verify()
 // helper methods. Common parameters include a filepath/filename and a user
-// map[string]string. Read() and Write() methods are guarded by a method
-// which checks for presence of the dumpFile before contuing.
+// map. The package is unaware of the map's value type; any value that can be
+// encoded as JSON may be used. Read() and Write() methods are guarded by a
+// method which checks for presence of the dumpFile before contuing.
 package backup
 
 import (
@@ -39,9 +40,9 @@ func Exists(dumpFile string) (mode os.FileMode, err error) {
 }
 
 // If dumpFile exists, read the JSON encoded documents into
-// users. Undetermined behaviour if map is not string to string.
-// Will not unmarshall into users unless file is read successfully.
-func Read(dumpFile string, target map[string]string) (err error) {
+// target, which must be a pointer to a map. Will not unmarshall
+// into target unless file is read successfully.
+func Read(dumpFile string, target interface{}) (err error) {
 
 	var contents []byte
 
@@ -56,17 +57,19 @@ func Read(dumpFile string, target map[string]string) (err error) {
 	}
 
 	log.Trace("backup: Deserializing into target map.")
-	err = json.Unmarshal(contents, &target)
+	err = json.Unmarshal(contents, target)
 	return
 }
 
+// Reads dumpFile into new value of the same type as original
+// before comparing the two.
 // Credit for advice on reflect package and DeepEqual: http://goo.gl/VqeDyZ
-func verify(dumpFile string, original map[string]string) (err error) {
-	compare := make(map[string]string)
-	if err = Read(dumpFile, compare); err != nil {
+func verify(dumpFile string, original interface{}) (err error) {
+	compare := reflect.New(reflect.TypeOf(original))
+	if err = Read(dumpFile, compare.Interface()); err != nil {
 		return
 	}
-	if equal := reflect.DeepEqual(original, compare); !equal {
+	if equal := reflect.DeepEqual(original, compare.Elem().Interface()); !equal {
 		err = errors.New("backup: Backup data not equal to original.")
 		return
 	}
@@ -78,7 +81,7 @@ func verify(dumpFile string, original map[string]string) (err error) {
 // writes JSON encoded document to disk given user parameter. Will rename
 // existing dumpFile, but will not delete until new dumpFile can be parsed
 // and verified to contain data that is identical to users.
-func Write(dumpFile string, userCopy map[string]string) (err error) {
+func Write(dumpFile string, userCopy interface{}) (err error) {
 
 	var mode os.FileMode
 	var data []byte
@@ -96,7 +99,7 @@ func Write(dumpFile string, userCopy map[string]string) (err error) {
 	}
 
 	log.Trace("backup: Serializing duplicate user's map.")
-	if data, err = json.Marshal(&userCopy); err != nil {
+	if data, err = json.Marshal(userCopy); err != nil {
 		return
 	}
 
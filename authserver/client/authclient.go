@@ -3,38 +3,122 @@
 //  Proprietary and confidential
 //  Written by Pat Kaehuaea, February 2015
 //
-// Package exposes AuthClient as interface to authserver. Exposes methods
-// to construct a new AuthClient as well as Get() and Set() users. Both
-// functions able to use request helper function because authserver implements
-// endpoints as GET rather than GET and POST.
+// Package exposes AuthClient as interface to authserver. Exposes methods to
+// construct a new AuthClient as well as Get() and Set() users and their
+// Prefs(). All of them are able to use the request helper function because
+// authserver implements endpoints as GET rather than GET and POST. Lookups
+// are retried with jittered exponential backoff, and every call passes
+// through a circuit breaker so that callers fail fast while authserver is
+// down. Errors caused by authserver being unreachable or failing wrap
+// ErrUnavailable. Each call has a Context variant that gives up once its
+// context is done; the others use context.Background(). Requests are signed
+// when Keys is set. Calls are spread across one or more authserver endpoints
+// by a Balancer, and retries fail over to endpoints not yet tried without
+// waiting.
 package client
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	log "github.com/cihub/seelog"
+	"github.com/patkaehuaea/command/authserver/people"
+	"github.com/patkaehuaea/command/authserver/token"
+	"github.com/patkaehuaea/command/clock"
+	"github.com/patkaehuaea/command/stats"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
 const (
 	AUTH_SCHEME = "http"
+
+	// Set by followers refusing writes, which a primary may take.
+	ROLE_HEADER   = "X-Authserver-Role"
+	ROLE_FOLLOWER = "follower"
+
+	DEFAULT_RETRIES           = 2
+	DEFAULT_BACKOFF           = 50 * time.Millisecond
+	DEFAULT_MAX_BACKOFF       = 1 * time.Second
+	DEFAULT_BREAKER_THRESHOLD = 5
+	DEFAULT_BREAKER_COOLDOWN  = 10 * time.Second
+)
+
+var (
+	ErrUnavailable = errors.New("auth: Authserver unavailable")
+
+	// Wrapped along with ErrUnavailable, as authserver can't be used
+	// until keys agree.
+	ErrUnauthorized = errors.New("auth: Authserver refused request signature")
+
+	// Wrapped along with ErrUnavailable when a follower refuses a
+	// write. Such writes are retried on other endpoints.
+	ErrReadOnly = errors.New("auth: Authserver is a read-only follower")
 )
 
-// Host and port stored as strings, with
-// port expected in form ':8080'.
+// Exported fields may be changed before the
+// client is first used.
 type AuthClient struct {
-	host   string
-	port   string
 	client *http.Client
+
+	// URL scheme, AUTH_SCHEME unless set by UseTransport().
+	Scheme string
+
+	// Retries made by idempotent calls after the first attempt.
+	MaxRetries int
+
+	// Wait before the first retry, doubling with each retry up to
+	// MaxBackoff. Actual wait is chosen at random up to this value.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Times retry waits. Defaults to clock.Real.
+	Clock clock.Clock
+
+	Breaker *Breaker
+
+	// Chooses the endpoint each call is sent to.
+	Balancer *Balancer
+
+	// Signs every request when set; authserver started with
+	// --service-keys refuses unsigned requests.
+	Keys *token.Keyring
+
+	// Counts retries made.
+	Retried *stats.Counter
+
+	// Counts calls abandoned because their context was done, by
+	// operation and reason: canceled or deadline.
+	Canceled *stats.CounterVec
 }
 
 // Returns new auth client to calling function after initializing
-// new http client with timeoutMS as Timeout.
+// new http client with timeoutMS as Timeout. Port is expected in
+// form ':8080'. Connections are pooled per DefaultTransportOptions()
+// unless UseTransport() is called. Replace Balancer to use several
+// endpoints.
 func NewAuthClient(host string, port string, timeoutMS time.Duration) (ac *AuthClient) {
 	t := timeoutMS
-	c := &http.Client{Timeout: t}
-	ac = &AuthClient{host: host, port: port, client: c}
+	transport, _ := NewTransport(DefaultTransportOptions())
+	c := &http.Client{Timeout: t, Transport: transport}
+	balancer, _ := NewBalancer(POLICY_ROUND_ROBIN, []string{host + port})
+	ac = &AuthClient{
+		client:     c,
+		Scheme:     AUTH_SCHEME,
+		MaxRetries: DEFAULT_RETRIES,
+		Backoff:    DEFAULT_BACKOFF,
+		MaxBackoff: DEFAULT_MAX_BACKOFF,
+		Clock:      clock.Real,
+		Breaker:    NewBreaker(DEFAULT_BREAKER_THRESHOLD, DEFAULT_BREAKER_COOLDOWN),
+		Balancer:   balancer,
+		Retried:    stats.NewCounter(),
+		Canceled:   stats.NewCounterVec("op", "reason"),
+	}
 	return
 }
 
@@ -44,9 +128,14 @@ func NewAuthClient(host string, port string, timeoutMS time.Duration) (ac *AuthC
 // by authserver and empty otherwise. Error associated with
 // HTTP request are returned to caller.
 func (ac *AuthClient) Get(uuid string) (name string, err error) {
+	return ac.GetContext(context.Background(), uuid)
+}
+
+// As Get() but gives up, retries included, once ctx is done.
+func (ac *AuthClient) GetContext(ctx context.Context, uuid string) (name string, err error) {
 	log.Trace("auth: Get called.")
 	params := map[string]string{"cookie": uuid}
-	name, err = ac.request("get", params)
+	name, err = ac.request(ctx, "get", params, true)
 	log.Trace("auth: Get complete.")
 	return
 }
@@ -56,31 +145,214 @@ func (ac *AuthClient) Get(uuid string) (name string, err error) {
 // checking on UUID or name. Error associated with
 // HTTP request is returned to caller.
 func (ac *AuthClient) Set(uuid string, name string) (err error) {
+	return ac.SetContext(context.Background(), uuid, name)
+}
+
+// As Set() but gives up, retries included, once ctx is done.
+func (ac *AuthClient) SetContext(ctx context.Context, uuid string, name string) (err error) {
 	log.Trace("auth: Set called.")
 	params := map[string]string{"cookie": uuid, "name": name}
-	_, err = ac.request("set", params)
+	_, err = ac.request(ctx, "set", params, false)
 	log.Trace("auth: Set complete.")
 	return
 }
 
-// Takes the request path as an argument along with a map of parameters. Map is encoded
-// into URL then submitted via HTTP GET request to authserver. Returns the content of the
-// response as a string and error if request failed.
-func (ac *AuthClient) request(path string, params map[string]string) (contents string, err error) {
+// Calls private request method with "prefs" as parameter and
+// decodes JSON response. Returns error if user not found.
+func (ac *AuthClient) Prefs(uuid string) (prefs people.Prefs, err error) {
+	return ac.PrefsContext(context.Background(), uuid)
+}
+
+// As Prefs() but gives up, retries included, once ctx is done.
+func (ac *AuthClient) PrefsContext(ctx context.Context, uuid string) (prefs people.Prefs, err error) {
+	log.Trace("auth: Prefs called.")
+	params := map[string]string{"cookie": uuid}
+	var contents string
+	if contents, err = ac.request(ctx, "prefs", params, true); err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(contents), &prefs)
+	log.Trace("auth: Prefs complete.")
+	return
+}
+
+// Calls private request method with "setprefs" as parameter. All
+// preferences are replaced; empty fields clear the preference.
+func (ac *AuthClient) SetPrefs(uuid string, prefs people.Prefs) (err error) {
+	return ac.SetPrefsContext(context.Background(), uuid, prefs)
+}
+
+// As SetPrefs() but gives up, retries included, once ctx is done.
+func (ac *AuthClient) SetPrefsContext(ctx context.Context, uuid string, prefs people.Prefs) (err error) {
+	log.Trace("auth: SetPrefs called.")
+	params := map[string]string{
+		"cookie": uuid,
+		"tz":     prefs.TZ,
+		"format": prefs.Format,
+		"locale": prefs.Locale,
+		"zones":  strings.Join(prefs.Zones, ","),
+	}
+	_, err = ac.request(ctx, "setprefs", params, false)
+	log.Trace("auth: SetPrefs complete.")
+	return
+}
+
+// Requests authserver's liveness endpoint. Returns error if
+// authserver could not be reached or reported itself unhealthy.
+// Bypasses retries and the breaker so that the probe reflects
+// authserver's current state. Probes the endpoint the next call
+// would use, but does not count towards its ejection.
+func (ac *AuthClient) Ping() (err error) {
+	return ac.PingContext(context.Background())
+}
+
+// As Ping() but gives up once ctx is done. Makes a single attempt.
+func (ac *AuthClient) PingContext(ctx context.Context) (err error) {
+	log.Trace("auth: Ping called.")
+	var addr string
+	if addr, _, err = ac.Balancer.Pick(nil); err != nil {
+		return
+	}
+	defer ac.Balancer.Abandon(addr)
+	if _, err = ac.attempt(ctx, ac.uri(addr, "healthz", nil)); ctx.Err() != nil {
+		err = ac.canceled(ctx, "healthz")
+	}
+	log.Trace("auth: Ping complete.")
+	return
+}
+
+// Takes the request path as an argument along with a map of parameters. Idempotent
+// requests are retried while authserver is unavailable and ctx allows, on another
+// endpoint if one remains untried. Others are only retried when refused by a
+// follower. Returns the content of the response as a string and error if request
+// failed or status was other than 200.
+func (ac *AuthClient) request(ctx context.Context, path string, params map[string]string, idempotent bool) (contents string, err error) {
 	log.Trace("auth: Request called.")
 
-	var resp *http.Response
-	var body []byte
+	tried := make(map[string]bool)
+	for i := 0; i <= ac.MaxRetries; i++ {
+		if i > 0 && !idempotent && !errors.Is(err, ErrReadOnly) {
+			return
+		}
+		addr, repeat, pickErr := ac.Balancer.Pick(tried)
+		if pickErr != nil {
+			err = pickErr
+			return
+		}
+
+		// Failing over to an endpoint not yet tried needs no wait.
+		if repeat {
+			wait := ac.backoff(i)
+
+			// No point waiting for a retry that can't finish.
+			if deadline, ok := ctx.Deadline(); ok && deadline.Sub(ac.Clock.Now()) < wait {
+				ac.Balancer.Abandon(addr)
+				log.Debug("auth: Not retrying " + path + ", deadline too close.")
+				return
+			}
+			log.Debug("auth: Retrying " + path + " in " + wait.String() + ".")
+			select {
+			case <-ac.Clock.After(wait):
+			case <-ctx.Done():
+				ac.Balancer.Abandon(addr)
+				err = ac.canceled(ctx, path)
+				return
+			}
+		}
+		if i > 0 {
+			log.Debug("auth: Retrying " + path + " on " + addr + ".")
+			ac.Retried.Inc()
+		}
+		if !ac.Breaker.Allow() {
+			ac.Balancer.Abandon(addr)
+			err = fmt.Errorf("%w: circuit breaker open", ErrUnavailable)
+			return
+		}
+
+		// Errors other than unavailability, such as 404, show
+		// authserver is healthy. Abandoned calls say nothing
+		// about authserver either way.
+		tried[addr] = true
+		contents, err = ac.attempt(ctx, ac.uri(addr, path, params))
+		if ctx.Err() != nil {
+			ac.Breaker.Abandon()
+			ac.Balancer.Abandon(addr)
+			err = ac.canceled(ctx, path)
+			return
+		}
+		if !errors.Is(err, ErrUnavailable) {
+			ac.Breaker.Success()
+			ac.Balancer.Success(addr)
+			log.Trace("auth: Request complete.")
+			return
+		}
+
+		// Follower is healthy, just not the one to write to.
+		if errors.Is(err, ErrReadOnly) {
+			ac.Breaker.Success()
+			ac.Balancer.Success(addr)
+			log.Debug(err)
+			continue
+		}
+		ac.Breaker.Failure()
+		ac.Balancer.Failure(addr)
+		log.Warn(err)
+	}
+	return
+}
+
+// Logs and counts call to path abandoned because ctx is done.
+// Returned error wraps both ErrUnavailable and ctx.Err().
+func (ac *AuthClient) canceled(ctx context.Context, path string) error {
+	reason := "canceled"
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		reason = "deadline"
+	}
+	ac.Canceled.With(path, reason).Inc()
+	log.Info("auth: " + path + " abandoned, " + reason + ".")
+	return fmt.Errorf("%w: %s %w", ErrUnavailable, path, ctx.Err())
+}
+
+// Returns random wait before retry, the nth, chosen up to the
+// current exponential backoff (full jitter).
+func (ac *AuthClient) backoff(retry int) time.Duration {
+	ceiling := ac.Backoff << uint(retry-1)
+	if ceiling <= 0 || ceiling > ac.MaxBackoff {
+		ceiling = ac.MaxBackoff
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling))) + 1
+}
 
-	uri := url.URL{Scheme: AUTH_SCHEME, Host: ac.host + ac.port, Path: path}
+// Map is encoded into URL for submission via HTTP GET request to authserver.
+func (ac *AuthClient) uri(addr string, path string, params map[string]string) string {
+	uri := url.URL{Scheme: ac.Scheme, Host: addr, Path: path}
 	values := url.Values{}
 	for k, v := range params {
 		values.Add(k, v)
 	}
 	uri.RawQuery = values.Encode()
+	return uri.String()
+}
 
-	log.Debug("auth: Requesting URI - " + uri.String())
-	if resp, err = ac.client.Get(uri.String()); err != nil {
+// Makes a single request. Transport errors, 5xx and 401 responses
+// wrap ErrUnavailable, as do writes refused by a follower.
+func (ac *AuthClient) attempt(ctx context.Context, uri string) (contents string, err error) {
+	var req *http.Request
+	var resp *http.Response
+	var body []byte
+
+	if req, err = http.NewRequestWithContext(ctx, "GET", uri, nil); err != nil {
+		return
+	}
+	if ac.Keys != nil {
+		ac.Keys.Sign(req)
+	}
+	log.Debug("auth: Requesting URI - " + uri)
+	if resp, err = ac.client.Do(req); err != nil {
+		err = fmt.Errorf("%w: %v", ErrUnavailable, err)
 		return
 	}
 
@@ -90,9 +362,25 @@ func (ac *AuthClient) request(path string, params map[string]string) (contents s
 	// ensures response is valid.
 	defer resp.Body.Close()
 	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		err = fmt.Errorf("%w: %v", ErrUnavailable, err)
+		return
+	}
+	if resp.Header.Get(ROLE_HEADER) == ROLE_FOLLOWER && resp.StatusCode == http.StatusServiceUnavailable {
+		err = fmt.Errorf("%w: %w: %s refused by %s", ErrUnavailable, ErrReadOnly, resp.Request.URL.Path, resp.Request.URL.Host)
+		return
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		err = fmt.Errorf("%w: %s returned %s", ErrUnavailable, resp.Request.URL.Path, resp.Status)
+		return
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		err = fmt.Errorf("%w: %w: %s returned %s", ErrUnavailable, ErrUnauthorized, resp.Request.URL.Path, resp.Status)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("auth: %s returned %s", resp.Request.URL.Path, resp.Status)
 		return
 	}
 	contents = string(body)
-	log.Trace("auth: Request complete.")
 	return
 }
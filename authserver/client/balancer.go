@@ -0,0 +1,301 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"github.com/patkaehuaea/command/clock"
+	"github.com/patkaehuaea/command/stats"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policies for choosing the authserver a call is sent to.
+const (
+	POLICY_ROUND_ROBIN = "round-robin"
+	POLICY_LEAST       = "least-outstanding"
+
+	DEFAULT_EJECT_AFTER = 3
+	DEFAULT_EJECT_FOR   = 10 * time.Second
+)
+
+var (
+	ErrPolicy      = errors.New("auth: Policy must be round-robin or least-outstanding.")
+	ErrNoEndpoints = fmt.Errorf("%w: no endpoints", ErrUnavailable)
+)
+
+type endpoint struct {
+	addr         string
+	outstanding  int
+	failures     int
+	ejectedUntil time.Time
+}
+
+// Spreads calls across authserver endpoints. Endpoints failing
+// EjectAfter consecutive calls as unavailable are ejected for
+// EjectFor, after which a single failure ejects them again. Ejected
+// endpoints are still used if no others remain. Exported fields may
+// be changed before the balancer is first used.
+type Balancer struct {
+	sync.Mutex
+	endpoints []*endpoint
+	next      int
+
+	// POLICY_ROUND_ROBIN or POLICY_LEAST.
+	Policy string
+
+	// Zero disables ejection.
+	EjectAfter int
+	EjectFor   time.Duration
+
+	// Times ejections and paces Watch(). Defaults to clock.Real.
+	Clock clock.Clock
+
+	// Counts ejections by endpoint.
+	Ejected *stats.CounterVec
+}
+
+// Returns balancer over addrs, each a host:port, using policy.
+func NewBalancer(policy string, addrs []string) (b *Balancer, err error) {
+	if policy != POLICY_ROUND_ROBIN && policy != POLICY_LEAST {
+		return nil, ErrPolicy
+	}
+	b = &Balancer{
+		Policy:     policy,
+		EjectAfter: DEFAULT_EJECT_AFTER,
+		EjectFor:   DEFAULT_EJECT_FOR,
+		Clock:      clock.Real,
+		Ejected:    stats.NewCounterVec("endpoint"),
+	}
+	b.SetAddrs(addrs)
+	return
+}
+
+// Replaces endpoints with addrs. Endpoints that remain keep their
+// outstanding calls and ejection.
+func (b *Balancer) SetAddrs(addrs []string) {
+	b.Lock()
+	defer b.Unlock()
+	if reflect.DeepEqual(addrs, b.addrs()) {
+		return
+	}
+	current := make(map[string]*endpoint)
+	for _, e := range b.endpoints {
+		current[e.addr] = e
+	}
+	endpoints := make([]*endpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		e, ok := current[addr]
+		if !ok {
+			e = &endpoint{addr: addr}
+		}
+		endpoints = append(endpoints, e)
+	}
+	b.endpoints = endpoints
+	log.Info("auth: Endpoints now " + strings.Join(addrs, ", ") + ".")
+}
+
+// Returns addresses of all endpoints.
+func (b *Balancer) Addrs() []string {
+	b.Lock()
+	defer b.Unlock()
+	return b.addrs()
+}
+
+func (b *Balancer) addrs() []string {
+	addrs := make([]string, len(b.endpoints))
+	for i, e := range b.endpoints {
+		addrs[i] = e.addr
+	}
+	return addrs
+}
+
+// Returns number of endpoints not currently ejected.
+func (b *Balancer) Healthy() (n int) {
+	b.Lock()
+	defer b.Unlock()
+	now := b.Clock.Now()
+	for _, e := range b.endpoints {
+		if !now.Before(e.ejectedUntil) {
+			n++
+		}
+	}
+	return
+}
+
+// Returns address to send a call to, preferring endpoints that are
+// not ejected and not in tried, and whether it had already been
+// tried. Callers must report the outcome with Success(), Failure()
+// or Abandon().
+func (b *Balancer) Pick(tried map[string]bool) (addr string, repeat bool, err error) {
+	b.Lock()
+	defer b.Unlock()
+	if len(b.endpoints) == 0 {
+		return "", false, ErrNoEndpoints
+	}
+
+	now := b.Clock.Now()
+	candidates := b.filter(func(e *endpoint) bool { return !tried[e.addr] && !now.Before(e.ejectedUntil) })
+	if len(candidates) == 0 {
+		candidates = b.filter(func(e *endpoint) bool { return !tried[e.addr] })
+	}
+	if len(candidates) == 0 {
+		candidates, repeat = b.endpoints, true
+	}
+
+	// Starting from a rotating offset spreads ties under
+	// least-outstanding as well.
+	start := b.next % len(candidates)
+	b.next++
+	chosen := candidates[start]
+	if b.Policy == POLICY_LEAST {
+		for i := 1; i < len(candidates); i++ {
+			if e := candidates[(start+i)%len(candidates)]; e.outstanding < chosen.outstanding {
+				chosen = e
+			}
+		}
+	}
+	chosen.outstanding++
+	return chosen.addr, repeat, nil
+}
+
+func (b *Balancer) filter(keep func(e *endpoint) bool) (endpoints []*endpoint) {
+	for _, e := range b.endpoints {
+		if keep(e) {
+			endpoints = append(endpoints, e)
+		}
+	}
+	return
+}
+
+// Reports that the call to addr succeeded, or failed for reasons
+// other than the endpoint being unavailable.
+func (b *Balancer) Success(addr string) {
+	b.Lock()
+	defer b.Unlock()
+	if e := b.find(addr); e != nil {
+		e.outstanding--
+		e.failures = 0
+	}
+}
+
+// Reports that addr was unavailable, ejecting it after EjectAfter
+// consecutive failures.
+func (b *Balancer) Failure(addr string) {
+	b.Lock()
+	defer b.Unlock()
+	e := b.find(addr)
+	if e == nil {
+		return
+	}
+	e.outstanding--
+	e.failures++
+	now := b.Clock.Now()
+	if b.EjectAfter > 0 && e.failures >= b.EjectAfter && !now.Before(e.ejectedUntil) {
+		log.Warn("auth: Ejecting " + addr + " for " + b.EjectFor.String() + ".")
+		e.ejectedUntil = now.Add(b.EjectFor)
+		// One more failure after ejection ends ejects it again.
+		e.failures = b.EjectAfter - 1
+		b.Ejected.With(addr).Inc()
+	}
+}
+
+// Reports that the call to addr was abandoned or never made, which
+// says nothing about the endpoint.
+func (b *Balancer) Abandon(addr string) {
+	b.Lock()
+	defer b.Unlock()
+	if e := b.find(addr); e != nil {
+		e.outstanding--
+	}
+}
+
+func (b *Balancer) find(addr string) *endpoint {
+	for _, e := range b.endpoints {
+		if e.addr == addr {
+			return e
+		}
+	}
+	return nil
+}
+
+// Calls resolve every interval and replaces endpoints with the
+// addresses it returns. Endpoints are kept if resolve fails or finds
+// none. Runs until stop is closed.
+func (b *Balancer) Watch(resolve func() ([]string, error), interval time.Duration, stop <-chan struct{}) {
+	ticker := b.Clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			addrs, err := resolve()
+			if err == nil && len(addrs) == 0 {
+				err = ErrNoEndpoints
+			}
+			if err != nil {
+				log.Error("auth: Keeping previous endpoints: ", err)
+				continue
+			}
+			b.SetAddrs(addrs)
+		}
+	}
+}
+
+// Returns a resolver reading file, with one host:port per line.
+// Blank lines and lines starting with # are ignored.
+func FileResolver(file string) func() ([]string, error) {
+	return func() (addrs []string, err error) {
+		var f *os.File
+		if f, err = os.Open(file); err != nil {
+			return
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if _, _, err = net.SplitHostPort(line); err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, line)
+		}
+		err = scanner.Err()
+		return
+	}
+}
+
+// Returns a resolver looking up DNS SRV records for name, such as
+// _auth._tcp.example.com. Only targets with the lowest priority are
+// returned; weights are ignored.
+func SRVResolver(name string) func() ([]string, error) {
+	return func() (addrs []string, err error) {
+		var records []*net.SRV
+		if _, records, err = net.LookupSRV("", "", name); err != nil {
+			return
+		}
+		for _, srv := range records {
+			// Records are sorted by priority.
+			if srv.Priority != records[0].Priority {
+				break
+			}
+			host := strings.TrimSuffix(srv.Target, ".")
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+		return
+	}
+}
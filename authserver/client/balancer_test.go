@@ -0,0 +1,299 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package client
+
+import (
+	"errors"
+	log "github.com/cihub/seelog"
+	"github.com/patkaehuaea/command/clock"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2015, 3, 8, 9, 59, 30, 0, time.UTC)
+
+func TestMain(m *testing.M) {
+	log.ReplaceLogger(log.Disabled)
+	os.Exit(m.Run())
+}
+
+func newFakeBalancer(t *testing.T, policy string, addrs ...string) (*Balancer, *clock.Fake) {
+	t.Helper()
+	b, err := NewBalancer(policy, addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := clock.NewFake(start)
+	b.Clock = f
+	b.EjectAfter = 2
+	b.EjectFor = 10 * time.Second
+	return b, f
+}
+
+// Steps of a balancer test. Pick expects addr; the others report the
+// outcome of a call to addr. Advance moves the clock.
+const (
+	PICK = iota
+	SUCCESS
+	FAILURE
+	ABANDON
+	ADVANCE
+)
+
+type step struct {
+	op      int
+	addr    string
+	advance time.Duration
+}
+
+func TestBalancer(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		steps   []step
+		healthy int
+		ejected int
+	}{
+		{"round robin", POLICY_ROUND_ROBIN, []step{
+			{PICK, "a", 0}, {SUCCESS, "a", 0},
+			{PICK, "b", 0}, {SUCCESS, "b", 0},
+			{PICK, "c", 0}, {SUCCESS, "c", 0},
+			{PICK, "a", 0},
+		}, 3, 0},
+		{"round robin ignores outstanding calls", POLICY_ROUND_ROBIN, []step{
+			{PICK, "a", 0}, {PICK, "b", 0}, {PICK, "c", 0}, {PICK, "a", 0},
+		}, 3, 0},
+		{"least outstanding", POLICY_LEAST, []step{
+			{PICK, "a", 0}, {PICK, "b", 0}, {PICK, "c", 0},
+			{SUCCESS, "b", 0},
+			{PICK, "b", 0},
+			{ABANDON, "c", 0},
+			{PICK, "c", 0},
+		}, 3, 0},
+		{"ejected after consecutive failures", POLICY_ROUND_ROBIN, []step{
+			{PICK, "a", 0}, {FAILURE, "a", 0},
+			{PICK, "b", 0}, {SUCCESS, "b", 0},
+			{PICK, "c", 0}, {SUCCESS, "c", 0},
+			{PICK, "a", 0}, {FAILURE, "a", 0},
+			{PICK, "b", 0}, {SUCCESS, "b", 0},
+			{PICK, "c", 0}, {SUCCESS, "c", 0},
+			{PICK, "b", 0},
+		}, 2, 1},
+		{"success resets failures", POLICY_ROUND_ROBIN, []step{
+			{PICK, "a", 0}, {FAILURE, "a", 0},
+			{PICK, "b", 0}, {SUCCESS, "b", 0},
+			{PICK, "c", 0}, {SUCCESS, "c", 0},
+			{PICK, "a", 0}, {SUCCESS, "a", 0},
+			{PICK, "b", 0}, {SUCCESS, "b", 0},
+			{PICK, "c", 0}, {SUCCESS, "c", 0},
+			{PICK, "a", 0}, {FAILURE, "a", 0},
+		}, 3, 0},
+		{"returns after ejection", POLICY_ROUND_ROBIN, []step{
+			{PICK, "a", 0}, {FAILURE, "a", 0},
+			{PICK, "b", 0}, {SUCCESS, "b", 0},
+			{PICK, "c", 0}, {SUCCESS, "c", 0},
+			{PICK, "a", 0}, {FAILURE, "a", 0},
+			{ADVANCE, "", 10 * time.Second},
+			{PICK, "b", 0}, {SUCCESS, "b", 0},
+			{PICK, "c", 0}, {SUCCESS, "c", 0},
+			{PICK, "a", 0},
+		}, 3, 1},
+		{"ejected again by one failure", POLICY_ROUND_ROBIN, []step{
+			{PICK, "a", 0}, {FAILURE, "a", 0},
+			{PICK, "b", 0}, {SUCCESS, "b", 0},
+			{PICK, "c", 0}, {SUCCESS, "c", 0},
+			{PICK, "a", 0}, {FAILURE, "a", 0},
+			{ADVANCE, "", 10 * time.Second},
+			{PICK, "b", 0}, {SUCCESS, "b", 0},
+			{PICK, "c", 0}, {SUCCESS, "c", 0},
+			{PICK, "a", 0}, {FAILURE, "a", 0},
+		}, 2, 2},
+		{"ejected endpoints used when none remain", POLICY_ROUND_ROBIN, []step{
+			{PICK, "a", 0}, {FAILURE, "a", 0},
+			{PICK, "b", 0}, {FAILURE, "b", 0},
+			{PICK, "c", 0}, {FAILURE, "c", 0},
+			{PICK, "a", 0}, {FAILURE, "a", 0},
+			{PICK, "b", 0}, {FAILURE, "b", 0},
+			{PICK, "c", 0}, {FAILURE, "c", 0},
+			{PICK, "a", 0},
+		}, 0, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, f := newFakeBalancer(t, test.policy, "a", "b", "c")
+			for i, s := range test.steps {
+				switch s.op {
+				case PICK:
+					addr, repeat, err := b.Pick(nil)
+					if err != nil || repeat || addr != s.addr {
+						t.Fatalf("step %d: Pick() = %q, %v, %v, want %q", i, addr, repeat, err, s.addr)
+					}
+				case SUCCESS:
+					b.Success(s.addr)
+				case FAILURE:
+					b.Failure(s.addr)
+				case ABANDON:
+					b.Abandon(s.addr)
+				case ADVANCE:
+					f.Advance(s.advance)
+				}
+			}
+			if got := b.Healthy(); got != test.healthy {
+				t.Errorf("Healthy() = %d, want %d", got, test.healthy)
+			}
+			var ejected uint64
+			for _, addr := range []string{"a", "b", "c"} {
+				ejected += b.Ejected.With(addr).Value()
+			}
+			if ejected != uint64(test.ejected) {
+				t.Errorf("ejections = %d, want %d", ejected, test.ejected)
+			}
+		})
+	}
+}
+
+func TestPickTried(t *testing.T) {
+	tests := []struct {
+		name   string
+		tried  map[string]bool
+		want   string
+		repeat bool
+	}{
+		{"skips tried", map[string]bool{"a": true}, "b", false},
+		{"skips all tried", map[string]bool{"a": true, "b": true}, "c", false},
+		{"repeats once all tried", map[string]bool{"a": true, "b": true, "c": true}, "a", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, _ := newFakeBalancer(t, POLICY_ROUND_ROBIN, "a", "b", "c")
+			addr, repeat, err := b.Pick(test.tried)
+			if err != nil || addr != test.want || repeat != test.repeat {
+				t.Errorf("Pick() = %q, %v, %v, want %q, %v", addr, repeat, err, test.want, test.repeat)
+			}
+		})
+	}
+
+	b, _ := newFakeBalancer(t, POLICY_ROUND_ROBIN)
+	if _, _, err := b.Pick(nil); !errors.Is(err, ErrNoEndpoints) || !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Pick() without endpoints = %v, want %v", err, ErrNoEndpoints)
+	}
+}
+
+func TestSetAddrsKeepsEjection(t *testing.T) {
+	b, _ := newFakeBalancer(t, POLICY_ROUND_ROBIN, "a", "b")
+	for i := 0; i < b.EjectAfter; i++ {
+		b.Pick(map[string]bool{"b": true})
+		b.Failure("a")
+	}
+	b.SetAddrs([]string{"c", "a"})
+	if got := b.Addrs(); !reflect.DeepEqual(got, []string{"c", "a"}) {
+		t.Errorf("Addrs() = %v, want [c a]", got)
+	}
+	if got := b.Healthy(); got != 1 {
+		t.Errorf("Healthy() = %d, want 1 as a stays ejected", got)
+	}
+}
+
+// Returns authserver stand-in that answers every call with status,
+// counting calls in n.
+func newEndpoint(t *testing.T, status int, n *int64) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(n, 1)
+		if status == http.StatusServiceUnavailable && strings.HasPrefix(r.URL.Path, "/set") {
+			w.Header().Set(ROLE_HEADER, ROLE_FOLLOWER)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("pat"))
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestFailover(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		call    func(ac *AuthClient) error
+		wantErr error
+		down    int64
+		healthy int64
+		retried uint64
+	}{
+		{"lookup fails over", http.StatusInternalServerError, func(ac *AuthClient) error {
+			_, err := ac.Get("d5a0d9c2-0f6b-4b7e-9a2b-5f4c3e2d1a00")
+			return err
+		}, nil, 1, 1, 1},
+		{"write is not retried", http.StatusInternalServerError, func(ac *AuthClient) error {
+			return ac.Set("d5a0d9c2-0f6b-4b7e-9a2b-5f4c3e2d1a00", "pat")
+		}, ErrUnavailable, 1, 0, 0},
+		{"write refused by follower fails over", http.StatusServiceUnavailable, func(ac *AuthClient) error {
+			return ac.Set("d5a0d9c2-0f6b-4b7e-9a2b-5f4c3e2d1a00", "pat")
+		}, nil, 1, 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var down, healthy int64
+			bad := newEndpoint(t, test.status, &down)
+			good := newEndpoint(t, http.StatusOK, &healthy)
+
+			ac := NewAuthClient(bad, "", time.Second)
+			ac.Balancer, _ = newFakeBalancer(t, POLICY_ROUND_ROBIN, bad, good)
+			// Failing over must not wait for backoff.
+			ac.Backoff, ac.MaxBackoff = time.Hour, time.Hour
+
+			if err := test.call(ac); !errors.Is(err, test.wantErr) {
+				t.Fatalf("call = %v, want %v", err, test.wantErr)
+			}
+			if down != test.down || healthy != test.healthy {
+				t.Errorf("calls = %d to failing, %d to healthy endpoint, want %d, %d", down, healthy, test.down, test.healthy)
+			}
+			if got := ac.Retried.Value(); got != test.retried {
+				t.Errorf("Retried = %d, want %d", got, test.retried)
+			}
+		})
+	}
+}
+
+func TestFailoverEjects(t *testing.T) {
+	var down, healthy int64
+	bad := newEndpoint(t, http.StatusInternalServerError, &down)
+	good := newEndpoint(t, http.StatusOK, &healthy)
+
+	ac := NewAuthClient(bad, "", time.Second)
+	ac.Balancer, _ = newFakeBalancer(t, POLICY_ROUND_ROBIN, bad, good)
+	f := ac.Balancer.Clock.(*clock.Fake)
+	const calls = 10
+	for i := 0; i < calls; i++ {
+		if _, err := ac.Get("d5a0d9c2-0f6b-4b7e-9a2b-5f4c3e2d1a00"); err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+	if down != int64(ac.Balancer.EjectAfter) {
+		t.Errorf("failing endpoint called %d times, want %d before ejection", down, ac.Balancer.EjectAfter)
+	}
+	if got := ac.Balancer.Ejected.With(bad).Value(); got != 1 {
+		t.Errorf("ejections = %d, want 1", got)
+	}
+
+	// Tried again, and ejected at once, after EjectFor.
+	f.Advance(ac.Balancer.EjectFor)
+	for i := 0; i < calls; i++ {
+		ac.Get("d5a0d9c2-0f6b-4b7e-9a2b-5f4c3e2d1a00")
+	}
+	if down != int64(ac.Balancer.EjectAfter)+1 {
+		t.Errorf("failing endpoint called %d times, want %d", down, ac.Balancer.EjectAfter+1)
+	}
+	if got := ac.Balancer.Ejected.With(bad).Value(); got != 2 {
+		t.Errorf("ejections = %d, want 2", got)
+	}
+}
@@ -0,0 +1,127 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package client
+
+import (
+	log "github.com/cihub/seelog"
+	"github.com/patkaehuaea/command/clock"
+	"sync"
+	"time"
+)
+
+const (
+	BREAKER_CLOSED = iota
+	BREAKER_HALF_OPEN
+	BREAKER_OPEN
+)
+
+var BREAKER_STATES = map[int]string{
+	BREAKER_CLOSED:    "closed",
+	BREAKER_HALF_OPEN: "half-open",
+	BREAKER_OPEN:      "open",
+}
+
+// Circuit breaker that opens after threshold consecutive failures.
+// While open, calls fail fast; after cooldown a single trial call is
+// let through (half-open) and its outcome closes or reopens the
+// breaker. A threshold of zero disables the breaker.
+type Breaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     int
+	failures  int
+	openedAt  time.Time
+	trips     uint64
+	rejected  uint64
+
+	// Times the cooldown. Defaults to clock.Real.
+	Clock clock.Clock
+}
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown, Clock: clock.Real}
+}
+
+// Returns true if a call may proceed. Callers that are allowed must
+// report the outcome with Success(), Failure() or Abandon().
+func (b *Breaker) Allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case BREAKER_OPEN:
+		if b.Clock.Now().Sub(b.openedAt) < b.cooldown {
+			b.rejected++
+			return false
+		}
+		log.Info("auth: Circuit breaker half-open.")
+		b.state = BREAKER_HALF_OPEN
+		return true
+	case BREAKER_HALF_OPEN:
+		// Only the trial call may proceed until it reports.
+		b.rejected++
+		return false
+	}
+	return true
+}
+
+func (b *Breaker) Success() {
+	b.Lock()
+	defer b.Unlock()
+	if b.state != BREAKER_CLOSED {
+		log.Info("auth: Circuit breaker closed.")
+	}
+	b.state = BREAKER_CLOSED
+	b.failures = 0
+}
+
+func (b *Breaker) Failure() {
+	b.Lock()
+	defer b.Unlock()
+	b.failures++
+	if b.threshold == 0 {
+		return
+	}
+	if b.state == BREAKER_HALF_OPEN || b.failures >= b.threshold {
+		if b.state != BREAKER_OPEN {
+			log.Warn("auth: Circuit breaker open.")
+			b.trips++
+		}
+		b.state = BREAKER_OPEN
+		b.openedAt = b.Clock.Now()
+	}
+}
+
+// Reports that an allowed call gave up without an outcome. A trial
+// call's slot is released so the next call may try instead.
+func (b *Breaker) Abandon() {
+	b.Lock()
+	defer b.Unlock()
+	if b.state == BREAKER_HALF_OPEN {
+		b.state = BREAKER_OPEN
+	}
+}
+
+// Returns one of BREAKER_CLOSED, BREAKER_HALF_OPEN or BREAKER_OPEN.
+func (b *Breaker) State() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
+
+// Returns number of times the breaker has opened.
+func (b *Breaker) Trips() uint64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.trips
+}
+
+// Returns number of calls failed fast while open.
+func (b *Breaker) Rejected() uint64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.rejected
+}
@@ -0,0 +1,80 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package client
+
+import (
+	"github.com/patkaehuaea/command/clock"
+	"testing"
+	"time"
+)
+
+// Steps of a breaker test. ALLOW expects allowed; the others report
+// the outcome of an allowed call or move the clock.
+const (
+	ALLOW = iota
+	SUCCEED
+	FAIL
+	GIVE_UP
+	WAIT
+)
+
+func TestBreaker(t *testing.T) {
+	const cooldown = 10 * time.Second
+	steps := []struct {
+		op      int
+		allowed bool
+		wait    time.Duration
+		state   int
+	}{
+		{ALLOW, true, 0, BREAKER_CLOSED},
+		{FAIL, false, 0, BREAKER_CLOSED},
+		{ALLOW, true, 0, BREAKER_CLOSED},
+		{FAIL, false, 0, BREAKER_OPEN},
+		{ALLOW, false, 0, BREAKER_OPEN},
+		{WAIT, false, cooldown - time.Nanosecond, BREAKER_OPEN},
+		{ALLOW, false, 0, BREAKER_OPEN},
+		{WAIT, false, time.Nanosecond, BREAKER_OPEN},
+		{ALLOW, true, 0, BREAKER_HALF_OPEN},
+		{ALLOW, false, 0, BREAKER_HALF_OPEN},
+		{FAIL, false, 0, BREAKER_OPEN},
+
+		// Failed trial restarts the cooldown.
+		{WAIT, false, cooldown - time.Nanosecond, BREAKER_OPEN},
+		{ALLOW, false, 0, BREAKER_OPEN},
+		{WAIT, false, time.Nanosecond, BREAKER_OPEN},
+		{ALLOW, true, 0, BREAKER_HALF_OPEN},
+		{GIVE_UP, false, 0, BREAKER_OPEN},
+		{ALLOW, true, 0, BREAKER_HALF_OPEN},
+		{SUCCEED, false, 0, BREAKER_CLOSED},
+		{ALLOW, true, 0, BREAKER_CLOSED},
+	}
+
+	f := clock.NewFake(start)
+	b := NewBreaker(2, cooldown)
+	b.Clock = f
+	for i, s := range steps {
+		switch s.op {
+		case ALLOW:
+			if allowed := b.Allow(); allowed != s.allowed {
+				t.Fatalf("step %d: Allow() = %v, want %v", i, allowed, s.allowed)
+			}
+		case SUCCEED:
+			b.Success()
+		case FAIL:
+			b.Failure()
+		case GIVE_UP:
+			b.Abandon()
+		case WAIT:
+			f.Advance(s.wait)
+		}
+		if state := b.State(); state != s.state {
+			t.Fatalf("step %d: state = %s, want %s", i, BREAKER_STATES[state], BREAKER_STATES[s.state])
+		}
+	}
+	if trips, rejected := b.Trips(), b.Rejected(); trips != 2 || rejected != 4 {
+		t.Errorf("Trips(), Rejected() = %d, %d, want 2, 4", trips, rejected)
+	}
+}
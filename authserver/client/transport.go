@@ -0,0 +1,129 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Protocols AuthClient may speak to authserver.
+const (
+	PROTOCOL_HTTP1 = "http1"
+	// HTTP/2 over cleartext with prior knowledge; authserver must
+	// be started with the same protocol.
+	PROTOCOL_H2C = "h2c"
+	// HTTP/2 over TLS, negotiated with ALPN.
+	PROTOCOL_H2 = "h2"
+
+	DEFAULT_MAX_IDLE_PER_HOST = 64
+	DEFAULT_IDLE_TIMEOUT      = 90 * time.Second
+	DEFAULT_DIAL_TIMEOUT      = 2 * time.Second
+	DEFAULT_TLS_TIMEOUT       = 5 * time.Second
+	DEFAULT_KEEP_ALIVE        = 30 * time.Second
+)
+
+var (
+	ErrProtocol   = errors.New("auth: Protocol must be http1, h2c or h2.")
+	ErrH2CWithTLS = errors.New("auth: h2c can't be used with TLS, use h2.")
+)
+
+// Settings for connections to authserver. Idle connections are kept
+// for reuse, up to MaxIdlePerHost, until IdleTimeout passes. Setting
+// TLSConfig enables TLS with any protocol; h2 without it uses TLS
+// verified against the system roots.
+type TransportOptions struct {
+	MaxIdlePerHost int
+	IdleTimeout    time.Duration
+	DialTimeout    time.Duration
+	TLSTimeout     time.Duration
+	Protocol       string
+	TLSConfig      *tls.Config
+}
+
+func DefaultTransportOptions() TransportOptions {
+	return TransportOptions{
+		MaxIdlePerHost: DEFAULT_MAX_IDLE_PER_HOST,
+		IdleTimeout:    DEFAULT_IDLE_TIMEOUT,
+		DialTimeout:    DEFAULT_DIAL_TIMEOUT,
+		TLSTimeout:     DEFAULT_TLS_TIMEOUT,
+		Protocol:       PROTOCOL_HTTP1,
+	}
+}
+
+// Returns the URL scheme used with protocol.
+func Scheme(protocol string) string {
+	if protocol == PROTOCOL_H2 {
+		return "https"
+	}
+	return AUTH_SCHEME
+}
+
+// Returns the protocols a server or transport should enable for
+// protocol. HTTP/1.1 is always enabled so that browsers and curl
+// can still reach authserver.
+func Protocols(protocol string) (p *http.Protocols, err error) {
+	p = new(http.Protocols)
+	p.SetHTTP1(true)
+	switch protocol {
+	case PROTOCOL_HTTP1:
+	case PROTOCOL_H2C:
+		p.SetUnencryptedHTTP2(true)
+	case PROTOCOL_H2:
+		p.SetHTTP2(true)
+	default:
+		return nil, ErrProtocol
+	}
+	return
+}
+
+// Returns transport configured by opts.
+func NewTransport(opts TransportOptions) (t *http.Transport, err error) {
+	var protocols *http.Protocols
+	if protocols, err = Protocols(opts.Protocol); err != nil {
+		return
+	}
+	if opts.Protocol == PROTOCOL_H2C && opts.TLSConfig != nil {
+		return nil, ErrH2CWithTLS
+	}
+
+	// Transport would otherwise try HTTP/1.1 first.
+	if opts.Protocol == PROTOCOL_H2C {
+		protocols.SetHTTP1(false)
+	}
+
+	dialer := &net.Dialer{Timeout: opts.DialTimeout, KeepAlive: DEFAULT_KEEP_ALIVE}
+	t = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        opts.MaxIdlePerHost,
+		MaxIdleConnsPerHost: opts.MaxIdlePerHost,
+		IdleConnTimeout:     opts.IdleTimeout,
+		TLSHandshakeTimeout: opts.TLSTimeout,
+		TLSClientConfig:     opts.TLSConfig,
+		ForceAttemptHTTP2:   opts.Protocol == PROTOCOL_H2,
+		Protocols:           protocols,
+	}
+	return
+}
+
+// Replaces client's transport with one configured by opts and sets
+// the scheme to match. Must be called before the client is used.
+func (ac *AuthClient) UseTransport(opts TransportOptions) (err error) {
+	var t *http.Transport
+	if t, err = NewTransport(opts); err != nil {
+		return
+	}
+	ac.client.Transport = t
+	ac.Scheme = Scheme(opts.Protocol)
+	if opts.TLSConfig != nil {
+		ac.Scheme = "https"
+	}
+	return
+}
@@ -0,0 +1,81 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package client
+
+import (
+	log "github.com/cihub/seelog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Returns authserver stand-in answering /get over protocol, and a
+// client using the same protocol. Requests arriving over another
+// protocol major version are counted in wrong.
+func newProtocolServer(b *testing.B, protocol string, wrong *int64) (*httptest.Server, *AuthClient) {
+	want := 1
+	if protocol != PROTOCOL_HTTP1 {
+		want = 2
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != want {
+			atomic.AddInt64(wrong, 1)
+		}
+		w.Write([]byte("pat"))
+	}))
+
+	opts := DefaultTransportOptions()
+	opts.Protocol = protocol
+	switch protocol {
+	case PROTOCOL_H2:
+		srv.EnableHTTP2 = true
+		srv.StartTLS()
+		opts.TLSConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	default:
+		protocols, err := Protocols(protocol)
+		if err != nil {
+			b.Fatal(err)
+		}
+		srv.Config.Protocols = protocols
+		srv.Start()
+	}
+
+	ac := NewAuthClient(strings.TrimPrefix(srv.URL, Scheme(protocol)+"://"), "", 0)
+	if err := ac.UseTransport(opts); err != nil {
+		b.Fatal(err)
+	}
+	return srv, ac
+}
+
+// Compares throughput of lookups over each protocol with many calls
+// in flight, as timeserver makes them.
+func BenchmarkTransport(b *testing.B) {
+	log.ReplaceLogger(log.Disabled)
+	for _, protocol := range []string{PROTOCOL_HTTP1, PROTOCOL_H2C, PROTOCOL_H2} {
+		b.Run(protocol, func(b *testing.B) {
+			var wrong int64
+			srv, ac := newProtocolServer(b, protocol, &wrong)
+			defer srv.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if name, err := ac.Get("d5a0d9c2-0f6b-4b7e-9a2b-5f4c3e2d1a00"); err != nil || name != "pat" {
+						b.Errorf("Get() = %q, %v", name, err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+			if wrong := atomic.LoadInt64(&wrong); wrong > 0 {
+				b.Errorf("%d requests not made over %s", wrong, protocol)
+			}
+		})
+	}
+}
@@ -4,21 +4,30 @@
 //  Written by Pat Kaehuaea, January 2015
 //
 // Package encapsulates a UserStore and acts as an in memory database. The
-// data store is implemented as a map[string]string wrapped by the UserStore
-// type. Helper methods are provided to Add(), Delete() and return Name()
-// data. Data is able to persist beyond program termination by utilizing
-// the backup package. The implementation of the "backup" is abstracted
-// from the data store by the referenced pacakge. Facilities to Dump(),
-// Load(), and Persist() the user data are provided.
+// data store is implemented as shards of map[string]User wrapped by the
+// UserStore type, each shard with its own lock so that users in different
+// shards can be changed concurrently, and so that Dump() holds up writers to
+// only one shard at a time. Helper methods are provided to Add(), Delete()
+// and return Name() and Prefs() data. Data is able to persist beyond program
+// termination by utilizing the backup package. The implementation of the
+// "backup" is abstracted from the data store by the referenced pacakge.
+// Facilities to Dump(), Load(), and Persist() the user data are provided.
+// Every change is numbered and may be observed through OnMutation, so that
+// another store can replay it with Apply() after starting from a Snapshot().
 package people
 
 import (
+	"encoding/json"
+	"errors"
 	log "github.com/cihub/seelog"
 	"github.com/patkaehuaea/command/authserver/backup"
+	"github.com/patkaehuaea/command/clock"
+	"hash/fnv"
 	"os/exec"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,50 +36,230 @@ import (
 const (
 	NAME_REGEX = "^[a-zA-Z]{2,35} {0,1}[a-zA-Z]{0,35}$"
 	UUID_REGEX = "[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}"
+
+	DEFAULT_SHARDS = 32
 )
 
-type UserStore struct {
+// Kinds of Mutation.
+const (
+	MUTATION_SET    = "set"
+	MUTATION_DELETE = "delete"
+)
+
+var (
+	ErrSequence = errors.New("people: Mutation is not the next in sequence.")
+	ErrMutation = errors.New("people: Mutation is malformed.")
+)
+
+// Settings a user may change from timeserver's profile page. Empty
+// fields indicate the user has no preference.
+type Prefs struct {
+	TZ     string   `json:"tz,omitempty"`
+	Format string   `json:"format,omitempty"`
+	Locale string   `json:"locale,omitempty"`
+	Zones  []string `json:"zones,omitempty"`
+}
+
+// Record stored for each UUID.
+type User struct {
+	Name string `json:"name"`
+	Prefs
+}
+
+// Dumpfiles written before preferences were introduced map each
+// UUID to a bare name. Accepting either form lets those files load.
+func (user *User) UnmarshalJSON(data []byte) (err error) {
+	var name string
+	if err = json.Unmarshal(data, &name); err == nil {
+		*user = User{Name: name}
+		return
+	}
+	type record User
+	var r record
+	if err = json.Unmarshal(data, &r); err == nil {
+		*user = User(r)
+	}
+	return
+}
+
+// Change made to the store, numbered by Seq from one. Set mutations
+// carry the user's whole record rather than the change to it.
+type Mutation struct {
+	Seq  uint64 `json:"seq"`
+	Op   string `json:"op"`
+	UUID string `json:"uuid,omitempty"`
+	User *User  `json:"user,omitempty"`
+}
+
+type shard struct {
 	sync.RWMutex
-	users map[string]string
+	users map[string]User
+}
+
+type UserStore struct {
+	shards []*shard
+
+	// Number of the last change. Incremented while holding the
+	// changed user's shard lock, so changes to one user are numbered
+	// in the order they were made.
+	seq uint64
+
+	// Called with every change once the user's shard is unlocked.
+	// Writers to different shards call it concurrently, so changes
+	// may arrive out of order; Seq gives the order. Optional; must be
+	// set before the store is changed.
+	OnMutation func(m Mutation)
+
+	// Called by Persist() after every checkpoint with the time taken
+	// and error, if any. Optional; must be set before Persist() runs.
+	OnCheckpoint func(elapsed time.Duration, err error)
+
+	// Paces and times Persist(). Defaults to clock.Real; must be
+	// set before Persist() runs.
+	Clock clock.Clock
+}
+
+// Returns shard holding user with id.
+func (u *UserStore) shard(id string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return u.shards[h.Sum32()%uint32(len(u.shards))]
 }
 
-// Adds a *Person to users map. Acquires RW lock before accessing resource.
+// Adds a user to users map, or renames if already present. Existing
+// preferences are kept. Acquires RW lock on user's shard before
+// accessing resource.
 func (u *UserStore) Add(id string, name string) {
-	u.Lock()
-	u.users[id] = name
-	u.Unlock()
+	s := u.shard(id)
+	s.Lock()
+	user := s.users[id]
+	user.Name = name
+	s.users[id] = user
+	m := u.mutated(MUTATION_SET, id, &user)
+	s.Unlock()
+	u.notify(m)
 }
 
-// Copies concurrent user store to non-concurrent user store
-// and calls backup.Write() to dump.
-func (u *UserStore) Dump(dumpFile string) (err error) {
-	copy := make(map[string]string)
-	u.Lock()
-	for uuid, name := range u.users {
-		copy[uuid] = name
+// Returns change numbered as the next in sequence. User's shard must
+// be locked.
+func (u *UserStore) mutated(op string, id string, user *User) Mutation {
+	return Mutation{Seq: atomic.AddUint64(&u.seq, 1), Op: op, UUID: id, User: user}
+}
+
+// Passes m to OnMutation, if set. User's shard must not be locked.
+func (u *UserStore) notify(m Mutation) {
+	if u.OnMutation != nil {
+		u.OnMutation(m)
+	}
+}
+
+// Makes change m, received from another store, which must follow the
+// last change made to this one. Changes must be applied one at a
+// time and the store not otherwise changed meanwhile.
+func (u *UserStore) Apply(m Mutation) (err error) {
+	if m.Op != MUTATION_DELETE && (m.Op != MUTATION_SET || m.User == nil) {
+		return ErrMutation
+	}
+	s := u.shard(m.UUID)
+	s.Lock()
+	if !atomic.CompareAndSwapUint64(&u.seq, m.Seq-1, m.Seq) {
+		s.Unlock()
+		return ErrSequence
+	}
+	if m.Op == MUTATION_SET {
+		s.users[m.UUID] = *m.User
+	} else {
+		delete(s.users, m.UUID)
+	}
+	s.Unlock()
+	u.notify(m)
+	return
+}
+
+// Returns number of the last change made to the store. Every change
+// up to it is visible to readers.
+func (u *UserStore) Seq() uint64 {
+	return atomic.LoadUint64(&u.seq)
+}
+
+// Returns copy of every user, and number of a change that every
+// earlier change is included in the copy. Shards are copied one at a
+// time, so later changes may be included too; as set mutations carry
+// whole records, replaying those after seq brings the copy up to date.
+func (u *UserStore) Snapshot() (users map[string]User, seq uint64) {
+	seq = u.Seq()
+	users = make(map[string]User)
+	for _, s := range u.shards {
+		s.RLock()
+		for uuid, user := range s.users {
+			users[uuid] = user
+		}
+		s.RUnlock()
+	}
+	return
+}
+
+// Replaces every user with those from another store's Snapshot(),
+// taken after its change numbered seq.
+func (u *UserStore) Restore(users map[string]User, seq uint64) {
+	for _, s := range u.shards {
+		s.Lock()
+		defer s.Unlock()
+		s.users = make(map[string]User)
+	}
+	for uuid, user := range users {
+		u.shard(uuid).users[uuid] = user
 	}
-	u.Unlock()
+	atomic.StoreUint64(&u.seq, seq)
+}
+
+// Performs read lock on each shard in turn and returns number of
+// users in the store.
+func (u *UserStore) Count() (count int) {
+	for _, s := range u.shards {
+		s.RLock()
+		count += len(s.users)
+		s.RUnlock()
+	}
+	return
+}
 
+// Copies concurrent user store to non-concurrent user store
+// and calls backup.Write() to dump. Shards are read locked one at a
+// time, so writers wait for at most one shard to be copied.
+func (u *UserStore) Dump(dumpFile string) (err error) {
+	copy, _ := u.Snapshot()
 	if err = backup.Write(dumpFile, copy); err != nil {
 		log.Error(err)
 	}
 	return
 }
 
-// Deletes *Person from users map whose ID is p.ID. Acquires RW lock before accessing resource.
+// Deletes *Person from users map whose ID is p.ID. Acquires RW lock on
+// user's shard before accessing resource.
 func (u *UserStore) Delete(id string, name string) {
-	u.Lock()
-	delete(u.users, id)
-	u.Unlock()
+	s := u.shard(id)
+	s.Lock()
+	_, ok := s.users[id]
+	var m Mutation
+	if ok {
+		delete(s.users, id)
+		m = u.mutated(MUTATION_DELETE, id, nil)
+	}
+	s.Unlock()
+	if ok {
+		u.notify(m)
+	}
 }
 
-// Performs read lock on Users. Returns true
+// Performs read lock on user's shard. Returns true
 // if user with id exists in map. Returns false
 // otherise.
 func (u *UserStore) Exists(id string) bool {
-	u.RLock()
-	_, ok := u.users[id]
-	u.RUnlock()
+	s := u.shard(id)
+	s.RLock()
+	_, ok := s.users[id]
+	s.RUnlock()
 	return ok
 }
 
@@ -84,6 +273,39 @@ func IsValidName(name string) bool {
 	return match
 }
 
+// Returns true if tz is empty, meaning no preference, or
+// names a location in the IANA time zone database.
+func IsValidTZ(tz string) bool {
+	if tz == "" {
+		return true
+	}
+	_, err := time.LoadLocation(tz)
+	return err == nil
+}
+
+// Returns true if every zone names a location in the IANA time
+// zone database. Empty names are not valid here.
+func IsValidZones(zones []string) bool {
+	for _, zone := range zones {
+		if zone == "" || !IsValidTZ(zone) {
+			return false
+		}
+	}
+	return true
+}
+
+// Splits comma separated list of zones, as submitted by forms and
+// query parameters, dropping blanks. Returns nil rather than an empty
+// slice when there are none so that Prefs round trip through backup.
+func SplitZones(list string) (zones []string) {
+	for _, zone := range strings.Split(list, ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			zones = append(zones, zone)
+		}
+	}
+	return
+}
+
 // Uses people.UUID_REGEX to determine if UUID passed
 // as parameter is valid.
 func IsValidUUID(value string) bool {
@@ -97,26 +319,78 @@ func IsValidUUID(value string) bool {
 // Calls backup.Read() to load dumpFile into concurrent users map.
 // Expects call on empty map.
 func (u *UserStore) Load(dumpFile string) (err error) {
-	u.Lock()
-	err = backup.Read(dumpFile, u.users)
-	u.Unlock()
+	users := make(map[string]User)
+	if err = backup.Read(dumpFile, &users); err != nil {
+		return
+	}
+	for uuid, user := range users {
+		s := u.shard(uuid)
+		s.Lock()
+		s.users[uuid] = user
+		s.Unlock()
+	}
 	return
 }
 
-// Performs read lock on Users and returns
+// Performs read lock on user's shard and returns
 // name of user with id. If not found, returns
 // empty string.
 func (u *UserStore) Name(id string) (name string) {
-	u.RLock()
-	name = u.users[id]
-	u.RUnlock()
+	s := u.shard(id)
+	s.RLock()
+	name = s.users[id].Name
+	s.RUnlock()
+	return
+}
+
+// Performs read lock on user's shard and returns preferences of
+// user with id. Ok is false if user not found.
+func (u *UserStore) Prefs(id string) (prefs Prefs, ok bool) {
+	var user User
+	s := u.shard(id)
+	s.RLock()
+	user, ok = s.users[id]
+	s.RUnlock()
+	prefs = user.Prefs
 	return
 }
 
-// Returns pointer to object of Users type. Map containing
-// state is initialized and ready for use.
+// Replaces preferences of user with id. Returns false without
+// modifying the store if user not found.
+func (u *UserStore) SetPrefs(id string, prefs Prefs) (ok bool) {
+	s := u.shard(id)
+	s.Lock()
+	var user User
+	var m Mutation
+	if user, ok = s.users[id]; ok {
+		user.Prefs = prefs
+		s.users[id] = user
+		m = u.mutated(MUTATION_SET, id, &user)
+	}
+	s.Unlock()
+	if ok {
+		u.notify(m)
+	}
+	return
+}
+
+// Returns pointer to object of Users type with DEFAULT_SHARDS
+// shards. Map containing state is initialized and ready for use.
 func NewUsers() *UserStore {
-	return &UserStore{users: make(map[string]string)}
+	return NewShardedUsers(DEFAULT_SHARDS)
+}
+
+// As NewUsers() but with n shards. More shards let more writers
+// proceed at once; one behaves as a single map with one lock.
+func NewShardedUsers(n int) *UserStore {
+	if n < 1 {
+		n = 1
+	}
+	u := &UserStore{shards: make([]*shard, n), Clock: clock.Real}
+	for i := range u.shards {
+		u.shards[i] = &shard{users: make(map[string]User)}
+	}
+	return u
 }
 
 // Loops through Dump(), and sleep whose duration determined
@@ -125,11 +399,16 @@ func NewUsers() *UserStore {
 func (u *UserStore) Persist(dumpFile string, wait time.Duration) {
 	for {
 		log.Trace("database: Beginning persist dump.")
-		if err := u.Dump(dumpFile); err != nil {
+		start := u.Clock.Now()
+		err := u.Dump(dumpFile)
+		if err != nil {
 			log.Error(err)
 		}
+		if u.OnCheckpoint != nil {
+			u.OnCheckpoint(u.Clock.Now().Sub(start), err)
+		}
 		log.Trace("database: Sleeping for " + wait.String())
-		time.Sleep(wait)
+		u.Clock.Sleep(wait)
 	}
 }
 
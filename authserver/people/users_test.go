@@ -0,0 +1,209 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package people
+
+import (
+	"fmt"
+	"github.com/patkaehuaea/command/clock"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	// Users held by stores under benchmark.
+	BENCH_USERS = 50000
+
+	// Pause between checkpoints taken during benchmarks.
+	BENCH_INTERVAL = 10 * time.Millisecond
+)
+
+func TestPersistPacing(t *testing.T) {
+	const wait = 30 * time.Second
+	f := clock.NewFake(time.Date(2015, 3, 8, 9, 59, 30, 0, time.UTC))
+	u := NewUsers()
+	u.Clock = f
+	checkpoints := make(chan error, 10)
+	u.OnCheckpoint = func(elapsed time.Duration, err error) { checkpoints <- err }
+	u.Add("d5a0d9c2-0f6b-4b7e-9a2b-5f4c3e2d1a00", "pat")
+
+	dumpFile := filepath.Join(t.TempDir(), "users.json")
+	go u.Persist(dumpFile, wait)
+
+	// Waits for a checkpoint and for Persist() to go back to sleep.
+	checkpoint := func(n int) {
+		t.Helper()
+		select {
+		case err := <-checkpoints:
+			if err != nil {
+				t.Fatalf("checkpoint %d: %v", n, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("checkpoint %d not taken", n)
+		}
+		for f.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	checkpoint(1)
+	f.Advance(wait - time.Nanosecond)
+	select {
+	case <-checkpoints:
+		t.Fatal("checkpoint taken before wait elapsed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	f.Advance(time.Nanosecond)
+	checkpoint(2)
+
+	restored := NewUsers()
+	if err := restored.Load(dumpFile); err != nil {
+		t.Fatal(err)
+	}
+	if name := restored.Name("d5a0d9c2-0f6b-4b7e-9a2b-5f4c3e2d1a00"); name != "pat" {
+		t.Errorf("restored name = %q, want %q", name, "pat")
+	}
+}
+
+// Writers to different shards proceed at once, so OnMutation may see
+// changes out of order, but every number is used once and changes to
+// one user are numbered in the order they were made.
+func TestMutationsNumbered(t *testing.T) {
+	const writers, writes = 8, 200
+	u := NewUsers()
+	var mu sync.Mutex
+	seen := make(map[uint64]Mutation)
+	u.OnMutation = func(m Mutation) {
+		mu.Lock()
+		seen[m.Seq] = m
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			id := fmt.Sprintf("%08x-0000-4000-8000-%012x", w, w)
+			for i := 0; i < writes; i++ {
+				u.Add(id, fmt.Sprintf("name%d", i))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if len(seen) != writers*writes || u.Seq() != writers*writes {
+		t.Fatalf("%d mutations seen, Seq() = %d, want %d", len(seen), u.Seq(), writers*writes)
+	}
+	last := make(map[string]string)
+	for seq := uint64(1); seq <= writers*writes; seq++ {
+		m, ok := seen[seq]
+		if !ok {
+			t.Fatalf("mutation %d not seen", seq)
+		}
+		last[m.UUID] = m.User.Name
+	}
+	for id, name := range last {
+		if got := u.Name(id); got != name {
+			t.Errorf("replaying in order leaves %s named %q, store has %q", id, name, got)
+		}
+	}
+}
+
+// Returns ids of BENCH_USERS users and a store with n shards holding
+// them.
+func benchStore(n int) (*UserStore, []string) {
+	u := NewShardedUsers(n)
+	ids := make([]string, BENCH_USERS)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%08x-0000-4000-8000-%012x", i, i)
+		u.Add(ids[i], "pat")
+	}
+	return u, ids
+}
+
+// Copies users as Dump() did before the store was sharded, holding
+// the write lock throughout.
+func lockedCopy(u *UserStore) {
+	copy := make(map[string]User)
+	for _, s := range u.shards {
+		s.Lock()
+		for uuid, user := range s.users {
+			copy[uuid] = user
+		}
+		s.Unlock()
+	}
+}
+
+// Runs op in parallel while checkpoints are taken, once against a
+// single map copied as Dump() did before sharding, and once against
+// DEFAULT_SHARDS copied by Snapshot() as Dump() does now. Writing the
+// copy out holds no lock, so is left out. Copies are spaced
+// BENCH_INTERVAL apart so that runs end in bounded time, and timing
+// starts once a second copy is under way. Reports checkpoints that
+// overlapped the timed ops.
+func benchDuringCheckpoints(b *testing.B, op func(u *UserStore, id string)) {
+	tests := []struct {
+		name       string
+		shards     int
+		checkpoint func(u *UserStore)
+	}{
+		{"single map", 1, lockedCopy},
+		{fmt.Sprintf("shards=%d", DEFAULT_SHARDS), DEFAULT_SHARDS, func(u *UserStore) { u.Snapshot() }},
+	}
+	for _, test := range tests {
+		b.Run(test.name, func(b *testing.B) {
+			u, ids := benchStore(test.shards)
+			stop := make(chan struct{})
+			second := make(chan struct{})
+			var started, done int64
+			var running sync.WaitGroup
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				for {
+					if atomic.AddInt64(&started, 1) == 2 {
+						close(second)
+					}
+					test.checkpoint(u)
+					atomic.AddInt64(&done, 1)
+					select {
+					case <-stop:
+						return
+					case <-time.After(BENCH_INTERVAL):
+					}
+				}
+			}()
+			<-second
+
+			var next int64
+			b.ResetTimer()
+			before := atomic.LoadInt64(&done)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&next, 1)
+					op(u, ids[i%BENCH_USERS])
+				}
+			})
+			b.StopTimer()
+			overlapped := atomic.LoadInt64(&started) - before
+			close(stop)
+			running.Wait()
+			b.ReportMetric(float64(overlapped), "checkpoints")
+		})
+	}
+}
+
+func BenchmarkAddDuringCheckpoints(b *testing.B) {
+	benchDuringCheckpoints(b, func(u *UserStore, id string) { u.Add(id, "kaehuaea") })
+}
+
+func BenchmarkNameDuringCheckpoints(b *testing.B) {
+	benchDuringCheckpoints(b, func(u *UserStore, id string) { u.Name(id) })
+}
@@ -0,0 +1,273 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package replica
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"github.com/patkaehuaea/command/authserver/people"
+	"github.com/patkaehuaea/command/authserver/token"
+	"github.com/patkaehuaea/command/clock"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_RETRY = 1 * time.Second
+
+	// Stream is abandoned if nothing, heartbeats included, arrives
+	// for this long.
+	IDLE_TIMEOUT = 3 * HEARTBEAT
+
+	MAX_LINE = 1 << 20
+)
+
+var (
+	ErrGone    = errors.New("replica: Primary no longer holds mutations needed, taking a new snapshot.")
+	ErrStopped = errors.New("replica: Follower already stopped.")
+)
+
+// Keeps a store up to date with a primary authserver.
+type Follower struct {
+	sync.Mutex
+	primary string
+	store   *people.UserStore
+	log     *Log
+	client  *http.Client
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped bool
+	done    chan struct{}
+
+	synced     bool
+	primarySeq uint64
+	contact    time.Time
+
+	// Signs requests to the primary when set.
+	Keys *token.Keyring
+
+	// Wait before reconnecting after an error.
+	Retry time.Duration
+
+	// Times retries, lag and the idle timeout. Defaults to
+	// clock.Real.
+	Clock clock.Clock
+}
+
+// Returns follower of the authserver at primary, a base URL such as
+// http://auth1:9080, copying into store and recording mutations
+// applied in l.
+func NewFollower(primary string, store *people.UserStore, l *Log, client *http.Client) *Follower {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Follower{
+		primary: primary,
+		store:   store,
+		log:     l,
+		client:  client,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		Retry:   DEFAULT_RETRY,
+		Clock:   clock.Real,
+	}
+}
+
+// Follows primary until Stop() is called. Must be called once.
+func (f *Follower) Run() {
+	ctx := f.ctx
+	defer close(f.done)
+
+	snapshot := true
+	for ctx.Err() == nil {
+		var err error
+		if snapshot {
+			err = f.snapshot(ctx)
+		}
+		if err == nil {
+			snapshot = false
+			err = f.stream(ctx)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, ErrGone) || errors.Is(err, people.ErrSequence) {
+			log.Warn(err)
+			snapshot = true
+			continue
+		}
+		log.Error("replica: Reconnecting to primary: ", err)
+		select {
+		case <-f.Clock.After(f.Retry):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// Stops following and waits for Run() to return. The store keeps
+// every mutation applied.
+func (f *Follower) Stop() error {
+	f.Lock()
+	stopped := f.stopped
+	f.stopped = true
+	f.Unlock()
+	if stopped {
+		return ErrStopped
+	}
+	f.cancel()
+	<-f.done
+	return nil
+}
+
+// Returns true once a snapshot has been loaded.
+func (f *Follower) Synced() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.synced
+}
+
+// Returns mutations made on the primary but not yet applied, as of
+// the last message from it, and time since that message.
+func (f *Follower) Lag() (mutations uint64, since time.Duration) {
+	applied := f.store.Seq()
+	f.Lock()
+	defer f.Unlock()
+	if f.primarySeq > applied {
+		mutations = f.primarySeq - applied
+	}
+	if !f.contact.IsZero() {
+		since = f.Clock.Now().Sub(f.contact)
+	}
+	return
+}
+
+// Records message from primary as of seq.
+func (f *Follower) heard(seq uint64) {
+	f.Lock()
+	f.contact = f.Clock.Now()
+	if seq > f.primarySeq {
+		f.primarySeq = seq
+	}
+	f.Unlock()
+}
+
+func (f *Follower) get(ctx context.Context, path string, query url.Values) (resp *http.Response, err error) {
+	uri := f.primary + path
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, "GET", uri, nil); err != nil {
+		return
+	}
+	if f.Keys != nil {
+		f.Keys.Sign(req)
+	}
+	if resp, err = f.client.Do(req); err != nil {
+		return
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, ErrGone
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("replica: %s returned %s", path, resp.Status)
+	}
+	return
+}
+
+// Replaces store contents with a snapshot from primary.
+func (f *Follower) snapshot(ctx context.Context) (err error) {
+	log.Info("replica: Taking snapshot from " + f.primary + ".")
+	var resp *http.Response
+	if resp, err = f.get(ctx, SNAPSHOT_PATH, nil); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var seq uint64
+	if seq, err = strconv.ParseUint(resp.Header.Get(SEQ_HEADER), 10, 64); err != nil {
+		return
+	}
+	users := make(map[string]people.User)
+	if err = json.NewDecoder(resp.Body).Decode(&users); err != nil {
+		return
+	}
+	f.store.Restore(users, seq)
+	f.log.Reset(resp.Header.Get(EPOCH_HEADER), seq)
+	f.Lock()
+	f.synced = true
+	f.primarySeq = seq
+	f.contact = f.Clock.Now()
+	f.Unlock()
+	log.Info("replica: Loaded " + strconv.Itoa(len(users)) + " users as of " + strconv.FormatUint(seq, 10) + ".")
+	return
+}
+
+// Applies mutations streamed from primary until the stream ends.
+func (f *Follower) stream(ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	query := url.Values{}
+	query.Set("epoch", f.log.Epoch())
+	query.Set("since", strconv.FormatUint(f.store.Seq(), 10))
+
+	var resp *http.Response
+	if resp, err = f.get(ctx, STREAM_PATH, query); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	log.Info("replica: Streaming from " + f.primary + ".")
+
+	lines := make(chan struct{}, 1)
+	go f.watch(ctx, cancel, lines)
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, MAX_LINE)
+	for scanner.Scan() {
+		select {
+		case lines <- struct{}{}:
+		default:
+		}
+		var m people.Mutation
+		if err = json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return
+		}
+		f.heard(m.Seq)
+		if m.Op == OP_HEARTBEAT {
+			continue
+		}
+		if err = f.store.Apply(m); err != nil {
+			return
+		}
+	}
+	if err = scanner.Err(); err == nil {
+		err = errors.New("replica: Primary closed stream.")
+	}
+	return
+}
+
+// Cancels a stream that goes IDLE_TIMEOUT without a line arriving on
+// lines. Returns when ctx is done.
+func (f *Follower) watch(ctx context.Context, cancel context.CancelFunc, lines <-chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-lines:
+		case <-f.Clock.After(IDLE_TIMEOUT):
+			log.Warn("replica: No heartbeat from primary within " + IDLE_TIMEOUT.String() + ".")
+			cancel()
+			return
+		}
+	}
+}
@@ -0,0 +1,252 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+//
+// Package replicates a UserStore from a primary authserver to followers. The
+// primary keeps recent mutations in a Log and serves a snapshot of the store,
+// in the same JSON form the backup package writes, along with a stream of the
+// mutations made since. A Follower loads the snapshot, then applies the stream,
+// and starts over from a new snapshot whenever it falls too far behind or the
+// primary restarts. Each Log is identified by an epoch so that sequence
+// numbers from different histories are never confused. Followers record what
+// they apply in a Log of their own, so a promoted follower can be followed in
+// turn.
+package replica
+
+import (
+	"encoding/json"
+	log "github.com/cihub/seelog"
+	"github.com/patkaehuaea/command/authserver/people"
+	"github.com/patkaehuaea/command/clock"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	SNAPSHOT_PATH = "/replication/snapshot"
+	STREAM_PATH   = "/replication/stream"
+
+	// Headers identifying the snapshot returned.
+	EPOCH_HEADER = "X-Replication-Epoch"
+	SEQ_HEADER   = "X-Replication-Seq"
+
+	// Sent in place of a mutation while the store is idle, carrying
+	// the primary's latest sequence number.
+	OP_HEARTBEAT = "heartbeat"
+	HEARTBEAT    = 2 * time.Second
+
+	DEFAULT_LOG_SIZE = 10000
+)
+
+// Recent mutations of a store, in order. Safe for concurrent use.
+type Log struct {
+	sync.Mutex
+	epoch    string
+	size     int
+	entries  []people.Mutation
+	last     uint64
+	pending  map[uint64]people.Mutation
+	changed  chan struct{}
+	watchers int
+
+	// Paces heartbeats to followers. Defaults to clock.Real.
+	Clock clock.Clock
+}
+
+// Returns log keeping the last size mutations, starting after seq,
+// with a new epoch.
+func NewLog(size int, seq uint64) *Log {
+	return &Log{
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		size:    size,
+		last:    seq,
+		pending: make(map[uint64]people.Mutation),
+		changed: make(chan struct{}),
+		Clock:   clock.Real,
+	}
+}
+
+// Records m. Suitable for UserStore.OnMutation, which may pass
+// mutations out of order; those arriving early are held until the
+// ones before them are appended.
+func (l *Log) Append(m people.Mutation) {
+	l.Lock()
+	defer l.Unlock()
+	if m.Seq <= l.last {
+		return
+	}
+	l.pending[m.Seq] = m
+	appended := false
+	for {
+		next, ok := l.pending[l.last+1]
+		if !ok {
+			break
+		}
+		delete(l.pending, next.Seq)
+		l.entries = append(l.entries, next)
+		l.last = next.Seq
+		appended = true
+	}
+	if !appended {
+		return
+	}
+	if len(l.entries) > l.size {
+		// Copying releases the array behind dropped entries.
+		l.entries = append([]people.Mutation(nil), l.entries[len(l.entries)-l.size:]...)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Discards mutations and continues, after seq, the history of
+// epoch.
+func (l *Log) Reset(epoch string, seq uint64) {
+	l.Lock()
+	defer l.Unlock()
+	l.epoch, l.entries, l.last = epoch, nil, seq
+	l.pending = make(map[uint64]people.Mutation)
+}
+
+// Waits until mutations up to seq have been appended, or done is
+// closed. Returns false in the latter case.
+func (l *Log) wait(seq uint64, done <-chan struct{}) bool {
+	for {
+		l.Lock()
+		last, changed := l.last, l.changed
+		l.Unlock()
+		if last >= seq {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-done:
+			return false
+		}
+	}
+}
+
+func (l *Log) Epoch() string {
+	l.Lock()
+	defer l.Unlock()
+	return l.epoch
+}
+
+// Returns number of followers streaming from the log.
+func (l *Log) Followers() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.watchers
+}
+
+// Returns mutations after seq, a channel closed when more are
+// appended, and the latest sequence number. Ok is false if
+// mutations after seq are no longer held, or never were.
+func (l *Log) since(seq uint64) (mutations []people.Mutation, changed <-chan struct{}, last uint64, ok bool) {
+	l.Lock()
+	defer l.Unlock()
+	changed, last = l.changed, l.last
+	first := l.last - uint64(len(l.entries))
+	if seq < first || seq > l.last {
+		return
+	}
+	mutations = append(mutations, l.entries[seq-first:]...)
+	ok = true
+	return
+}
+
+// Serves a snapshot of store, identified by the log's epoch and the
+// sequence number of the last mutation included.
+func SnapshotHandler(store *people.UserStore, l *Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Info("replica: Snapshot handler called.")
+		users, seq := store.Snapshot()
+
+		// Writers number changes before passing them to the log, so
+		// the last few may not have reached it yet. Streaming from
+		// seq would be refused until they do.
+		if !l.wait(seq, r.Context().Done()) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(EPOCH_HEADER, l.Epoch())
+		w.Header().Set(SEQ_HEADER, strconv.FormatUint(seq, 10))
+		if err := json.NewEncoder(w).Encode(users); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// Streams mutations after the since query parameter as lines of
+// JSON, with heartbeats while idle, until the client disconnects.
+// Responds 410 Gone if the epoch query parameter doesn't match or
+// the mutations are no longer held; the follower must then take a
+// new snapshot.
+func (l *Log) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Info("replica: Stream handler called.")
+
+	since, err := strconv.ParseUint(r.FormValue("since"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("epoch") != l.Epoch() {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	if _, _, _, ok := l.since(since); !ok {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	l.Lock()
+	l.watchers++
+	l.Unlock()
+	defer func() {
+		l.Lock()
+		l.watchers--
+		l.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	encoder := json.NewEncoder(w)
+	heartbeat := l.Clock.NewTicker(HEARTBEAT)
+	defer heartbeat.Stop()
+	for {
+		mutations, changed, last, ok := l.since(since)
+		if !ok {
+			// Fell behind; the follower's next request is refused.
+			log.Warn("replica: Follower at " + strconv.FormatUint(since, 10) + " fell behind, closing stream.")
+			return
+		}
+		for _, m := range mutations {
+			if err := encoder.Encode(m); err != nil {
+				return
+			}
+			since = m.Seq
+		}
+		if len(mutations) > 0 {
+			flusher.Flush()
+		}
+
+		select {
+		case <-changed:
+		case <-heartbeat.C():
+			if err := encoder.Encode(people.Mutation{Seq: last, Op: OP_HEARTBEAT}); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,247 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package replica
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"github.com/patkaehuaea/command/authserver/people"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.ReplaceLogger(log.Disabled)
+	os.Exit(m.Run())
+}
+
+// Returns id of the ith test user.
+func uuid(i int) string {
+	return fmt.Sprintf("%08x-0000-4000-8000-%012x", i, i)
+}
+
+// Serves store and l as authserver does for its followers.
+func newPrimary(t *testing.T, store *people.UserStore, l *Log) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle(SNAPSHOT_PATH, SnapshotHandler(store, l))
+	mux.Handle(STREAM_PATH, l)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Returns follower of primary, already running, with a store and log
+// of its own.
+func newFollower(t *testing.T, primary *httptest.Server) (*Follower, *people.UserStore, *Log) {
+	t.Helper()
+	store := people.NewUsers()
+	l := NewLog(DEFAULT_LOG_SIZE, 0)
+	store.OnMutation = l.Append
+	f := NewFollower(primary.URL, store, l, primary.Client())
+	f.Retry = 10 * time.Millisecond
+	go f.Run()
+	t.Cleanup(func() { f.Stop() })
+	return f, store, l
+}
+
+// Fails test if cond isn't true within five seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLogAppendOutOfOrder(t *testing.T) {
+	l := NewLog(3, 10)
+	for _, seq := range []uint64{12, 13, 10, 11, 14} {
+		l.Append(people.Mutation{Seq: seq, Op: people.MUTATION_DELETE, UUID: uuid(int(seq))})
+	}
+
+	tests := []struct {
+		since uint64
+		want  []uint64
+		ok    bool
+	}{
+		{10, nil, false},
+		{11, []uint64{12, 13, 14}, true},
+		{13, []uint64{14}, true},
+		{14, nil, true},
+		{15, nil, false},
+	}
+	for _, test := range tests {
+		mutations, _, last, ok := l.since(test.since)
+		var got []uint64
+		for _, m := range mutations {
+			got = append(got, m.Seq)
+		}
+		if last != 14 || ok != test.ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("since(%d) = %v, %d, %v; want %v, 14, %v", test.since, got, last, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestStreamRefused(t *testing.T) {
+	store := people.NewUsers()
+	l := NewLog(2, 0)
+	store.OnMutation = l.Append
+	for i := 0; i < 5; i++ {
+		store.Add(uuid(i), "pat")
+	}
+	srv := newPrimary(t, store, l)
+
+	tests := []struct {
+		name  string
+		epoch string
+		since uint64
+		want  int
+	}{
+		{"held", l.Epoch(), 3, http.StatusOK},
+		{"other epoch", "restarted", 3, http.StatusGone},
+		{"dropped", l.Epoch(), 2, http.StatusGone},
+		{"ahead", l.Epoch(), 6, http.StatusGone},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := url.Values{"epoch": {test.epoch}, "since": {strconv.FormatUint(test.since, 10)}}
+			resp, err := srv.Client().Get(srv.URL + STREAM_PATH + "?" + query.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, test.want)
+			}
+		})
+	}
+}
+
+// Follower snapshots while writers are busy, then applies what they
+// write until it holds the same users as the primary.
+func TestFollowerCatchesUp(t *testing.T) {
+	const writers = 4
+	store := people.NewUsers()
+	l := NewLog(DEFAULT_LOG_SIZE, 0)
+	store.OnMutation = l.Append
+	for i := 0; i < 1000; i++ {
+		store.Add(uuid(i), "pat")
+	}
+	srv := newPrimary(t, store, l)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; ; i += writers {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				store.Add(uuid(i%2000), "kaehuaea"+strconv.Itoa(i))
+				if i%7 == 0 {
+					store.Delete(uuid((i+500)%2000), "")
+				}
+			}
+		}(w)
+	}
+
+	f, followed, followedLog := newFollower(t, srv)
+	waitFor(t, "snapshot", f.Synced)
+	synced := store.Seq()
+	waitFor(t, "mutations after snapshot", func() bool { return followed.Seq() > synced+1000 })
+	close(stop)
+	wg.Wait()
+
+	waitFor(t, "follower to catch up", func() bool { return followed.Seq() == store.Seq() })
+	want, _ := store.Snapshot()
+	got, _ := followed.Snapshot()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("follower holds %d users, primary %d, and they differ", len(got), len(want))
+	}
+	if followedLog.Epoch() != l.Epoch() {
+		t.Errorf("follower epoch = %q, want primary's %q", followedLog.Epoch(), l.Epoch())
+	}
+	if lag, _ := f.Lag(); lag != 0 {
+		t.Errorf("Lag() = %d after catching up", lag)
+	}
+}
+
+// Primary that skips a sequence number in its first stream. The
+// follower must take a second snapshot rather than apply past the gap.
+func TestFollowerResnapshotsAfterGap(t *testing.T) {
+	var snapshots int32
+	mux := http.NewServeMux()
+	mux.HandleFunc(SNAPSHOT_PATH, func(w http.ResponseWriter, r *http.Request) {
+		users := map[string]people.User{uuid(1): {Name: "pat"}}
+		seq := "1"
+		if atomic.AddInt32(&snapshots, 1) > 1 {
+			users[uuid(3)] = people.User{Name: "kaehuaea"}
+			seq = "3"
+		}
+		w.Header().Set(EPOCH_HEADER, "first")
+		w.Header().Set(SEQ_HEADER, seq)
+		json.NewEncoder(w).Encode(users)
+	})
+	mux.HandleFunc(STREAM_PATH, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("since") == "1" {
+			json.NewEncoder(w).Encode(people.Mutation{Seq: 3, Op: people.MUTATION_SET, UUID: uuid(3), User: &people.User{Name: "kaehuaea"}})
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	f, followed, _ := newFollower(t, srv)
+	waitFor(t, "second snapshot", func() bool { return atomic.LoadInt32(&snapshots) == 2 && f.Synced() && followed.Seq() == 3 })
+	if name := followed.Name(uuid(3)); name != "kaehuaea" {
+		t.Errorf("user after gap named %q, want %q", name, "kaehuaea")
+	}
+}
+
+// Primary restarting with a new history refuses the follower's next
+// stream with 410, after which the follower takes a new snapshot.
+func TestFollowerResnapshotsOnNewEpoch(t *testing.T) {
+	store := people.NewUsers()
+	l := NewLog(DEFAULT_LOG_SIZE, 0)
+	store.OnMutation = l.Append
+	store.Add(uuid(1), "pat")
+	srv := newPrimary(t, store, l)
+
+	f, followed, followedLog := newFollower(t, srv)
+	waitFor(t, "snapshot", f.Synced)
+	waitFor(t, "stream", func() bool { return l.Followers() == 1 })
+
+	// As though restarted from a dumpfile missing the last change.
+	store.Restore(map[string]people.User{uuid(2): {Name: "kaehuaea"}}, 1)
+	l.Reset("restarted", 1)
+	srv.CloseClientConnections()
+
+	waitFor(t, "new epoch", func() bool { return followedLog.Epoch() == "restarted" })
+	waitFor(t, "new snapshot", func() bool { return followed.Name(uuid(2)) == "kaehuaea" })
+	if followed.Exists(uuid(1)) {
+		t.Error("user from previous epoch kept")
+	}
+	store.Add(uuid(3), "pat")
+	waitFor(t, "mutation in new epoch", func() bool { return followed.Name(uuid(3)) == "pat" })
+}
@@ -0,0 +1,199 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+//
+// Package signs requests from timeserver to authserver, and verifies them, with
+// HMAC-SHA256 keys shared by both servers. A signature covers the method, path,
+// query and time of the request, so a token can't be reused for other
+// parameters and is only accepted within MAX_SKEW of being made. Keys are read
+// from a file with one "id secret" pair per line. The first key signs and every
+// key verifies, so a key is rotated without downtime by adding the new key
+// after the current one on every server, moving it first, then removing the
+// old one. Files are reloaded when they change.
+package token
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	log "github.com/cihub/seelog"
+	"github.com/patkaehuaea/command/clock"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HEADER     = "Authorization"
+	SCHEME     = "HMAC"
+	MAX_SKEW   = 5 * time.Minute
+	MIN_SECRET = 32
+)
+
+var (
+	ErrNoKeys    = errors.New("token: No keys found in key file.")
+	ErrShortKey  = errors.New("token: Secrets must be at least 32 characters.")
+	ErrBadLine   = errors.New("token: Key file lines must be an id and a secret.")
+	ErrMissing   = errors.New("token: Request is not signed.")
+	ErrMalformed = errors.New("token: Signature is malformed.")
+	ErrUnknown   = errors.New("token: Signed with unknown key.")
+	ErrExpired   = errors.New("token: Signature is too old or too new.")
+	ErrMismatch  = errors.New("token: Signature does not match request.")
+)
+
+type key struct {
+	id     string
+	secret []byte
+}
+
+// Holds keys loaded from a file. Safe for concurrent use.
+type Keyring struct {
+	sync.RWMutex
+	file     string
+	keys     []key
+	modified time.Time
+
+	// Dates signatures and paces Watch(). Defaults to clock.Real.
+	Clock clock.Clock
+}
+
+// Returns keyring with keys loaded from file.
+func NewKeyring(file string) (k *Keyring, err error) {
+	k = &Keyring{file: file, Clock: clock.Real}
+	if err = k.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Loads keys again. Previously loaded keys are kept if the file
+// fails to load. Blank lines and lines starting with # are ignored.
+func (k *Keyring) Reload() (err error) {
+	var info os.FileInfo
+	if info, err = os.Stat(k.file); err != nil {
+		return
+	}
+	var f *os.File
+	if f, err = os.Open(k.file); err != nil {
+		return
+	}
+	defer f.Close()
+
+	var keys []key
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return ErrBadLine
+		}
+		if len(fields[1]) < MIN_SECRET {
+			return ErrShortKey
+		}
+		keys = append(keys, key{id: fields[0], secret: []byte(fields[1])})
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if len(keys) == 0 {
+		return ErrNoKeys
+	}
+
+	k.Lock()
+	k.keys, k.modified = keys, info.ModTime()
+	k.Unlock()
+	log.Info("token: Loaded " + strconv.Itoa(len(keys)) + " keys.")
+	return
+}
+
+// Checks file every interval and reloads it if changed. Runs until
+// stop is closed.
+func (k *Keyring) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := k.Clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			k.RLock()
+			modified := k.modified
+			k.RUnlock()
+			if info, err := os.Stat(k.file); err == nil && info.ModTime().Equal(modified) {
+				continue
+			}
+			if err := k.Reload(); err != nil {
+				log.Error("token: Keeping previous keys: ", err)
+			}
+		}
+	}
+}
+
+// Signs r with the first key, replacing any existing signature.
+func (k *Keyring) Sign(r *http.Request) {
+	k.RLock()
+	signer := k.keys[0]
+	k.RUnlock()
+	at := strconv.FormatInt(k.Clock.Now().Unix(), 10)
+	r.Header.Set(HEADER, SCHEME+" "+signer.id+":"+at+":"+signature(signer.secret, signer.id, at, r))
+}
+
+// Returns nil if r was signed by any key within MAX_SKEW of now.
+func (k *Keyring) Verify(r *http.Request) error {
+	value := r.Header.Get(HEADER)
+	if value == "" {
+		return ErrMissing
+	}
+	if !strings.HasPrefix(value, SCHEME+" ") {
+		return ErrMalformed
+	}
+	parts := strings.Split(strings.TrimPrefix(value, SCHEME+" "), ":")
+	if len(parts) != 3 {
+		return ErrMalformed
+	}
+	id, at, given := parts[0], parts[1], parts[2]
+	unix, err := strconv.ParseInt(at, 10, 64)
+	if err != nil {
+		return ErrMalformed
+	}
+
+	secret := k.secret(id)
+	if secret == nil {
+		return ErrUnknown
+	}
+	skew := k.Clock.Now().Sub(time.Unix(unix, 0))
+	if skew > MAX_SKEW || skew < -MAX_SKEW {
+		return ErrExpired
+	}
+	if !hmac.Equal([]byte(given), []byte(signature(secret, id, at, r))) {
+		return ErrMismatch
+	}
+	return nil
+}
+
+func (k *Keyring) secret(id string) []byte {
+	k.RLock()
+	defer k.RUnlock()
+	for _, key := range k.keys {
+		if key.id == id {
+			return key.secret
+		}
+	}
+	return nil
+}
+
+// Returns HMAC of the parts of r that a signature vouches for.
+func signature(secret []byte, id string, at string, r *http.Request) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id + "\n" + at + "\n" + r.Method + "\n" + r.URL.RequestURI()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,162 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package token
+
+import (
+	"errors"
+	"github.com/patkaehuaea/command/clock"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	OLD_KEY = "old 0123456789abcdef0123456789abcdef\n"
+	NEW_KEY = "new fedcba9876543210fedcba9876543210\n"
+	URI     = "/get?cookie=d5a0d9c2-0f6b-4b7e-9a2b-5f4c3e2d1a00"
+)
+
+var start = time.Date(2015, 3, 8, 9, 59, 30, 0, time.UTC)
+
+// Returns keyring loaded from a file holding lines, driven by f.
+func newKeyring(t *testing.T, f clock.Clock, lines ...string) *Keyring {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewKeyring(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Clock = f
+	return k
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(value string) string
+		uri     string
+		elapsed time.Duration
+		want    error
+	}{
+		{"valid", nil, URI, 0, nil},
+		{"within skew", nil, URI, MAX_SKEW, nil},
+		{"stale", nil, URI, MAX_SKEW + time.Second, ErrExpired},
+		{"from the future", nil, URI, -MAX_SKEW - time.Second, ErrExpired},
+		{"other parameters", nil, "/get?cookie=0c2d4a1e-8f3b-4c5d-9e6f-7a8b9c0d1e2f", 0, ErrMismatch},
+		{"other path", nil, "/set?cookie=d5a0d9c2-0f6b-4b7e-9a2b-5f4c3e2d1a00", 0, ErrMismatch},
+		{"tampered signature", func(v string) string { return v[:len(v)-2] + "AA" }, URI, 0, ErrMismatch},
+		{"tampered time", func(v string) string {
+			parts := strings.Split(v, ":")
+			parts[1] = "1425808771"
+			return strings.Join(parts, ":")
+		}, URI, 0, ErrMismatch},
+		{"unknown key", func(v string) string { return strings.Replace(v, "HMAC new:", "HMAC other:", 1) }, URI, 0, ErrUnknown},
+		{"unsigned", func(string) string { return "" }, URI, 0, ErrMissing},
+		{"other scheme", func(v string) string { return strings.Replace(v, SCHEME, "Bearer", 1) }, URI, 0, ErrMalformed},
+		{"missing part", func(v string) string { return v[:strings.LastIndex(v, ":")] }, URI, 0, ErrMalformed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := clock.NewFake(start)
+			k := newKeyring(t, f, NEW_KEY)
+
+			signed := httptest.NewRequest("GET", URI, nil)
+			k.Sign(signed)
+			value := signed.Header.Get(HEADER)
+			if test.tamper != nil {
+				value = test.tamper(value)
+			}
+
+			r := httptest.NewRequest("GET", test.uri, nil)
+			r.Header.Set(HEADER, value)
+			f.Advance(test.elapsed)
+			if err := k.Verify(r); !errors.Is(err, test.want) {
+				t.Errorf("Verify() = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// Follows the rotation described in the package comment: the new
+// key is added after the current one, moved first, then the old one
+// is removed.
+func TestRotation(t *testing.T) {
+	f := clock.NewFake(start)
+	sign := func(k *Keyring) string {
+		r := httptest.NewRequest("GET", URI, nil)
+		k.Sign(r)
+		return r.Header.Get(HEADER)
+	}
+	verify := func(k *Keyring, value string) error {
+		r := httptest.NewRequest("GET", URI, nil)
+		r.Header.Set(HEADER, value)
+		return k.Verify(r)
+	}
+
+	before := newKeyring(t, f, OLD_KEY)
+	added := newKeyring(t, f, OLD_KEY, NEW_KEY)
+	moved := newKeyring(t, f, NEW_KEY, OLD_KEY)
+	after := newKeyring(t, f, NEW_KEY)
+
+	if !strings.HasPrefix(sign(added), SCHEME+" old:") {
+		t.Error("added key signs before it is moved first")
+	}
+
+	// While servers are part way through, each accepts what the
+	// others sign.
+	for i, signer := range []*Keyring{before, added, moved} {
+		for j, verifier := range []*Keyring{added, moved} {
+			if err := verify(verifier, sign(signer)); err != nil {
+				t.Errorf("signer %d, verifier %d: %v", i, j, err)
+			}
+		}
+	}
+	if err := verify(before, sign(moved)); !errors.Is(err, ErrUnknown) {
+		t.Errorf("server without new key: Verify() = %v, want %v", err, ErrUnknown)
+	}
+	if err := verify(after, sign(before)); !errors.Is(err, ErrUnknown) {
+		t.Errorf("retired key: Verify() = %v, want %v", err, ErrUnknown)
+	}
+	if err := verify(after, sign(moved)); err != nil {
+		t.Errorf("new key after rotation: %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     error
+	}{
+		{"comments only", "# no keys\n\n", ErrNoKeys},
+		{"short secret", "short tooshort\n", ErrShortKey},
+		{"missing secret", "lonely\n", ErrBadLine},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k := newKeyring(t, clock.Real, OLD_KEY)
+			if err := os.WriteFile(k.file, []byte(test.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := k.Reload(); !errors.Is(err, test.want) {
+				t.Fatalf("Reload() = %v, want %v", err, test.want)
+			}
+
+			// Previous keys stay in use.
+			r := httptest.NewRequest("GET", URI, nil)
+			k.Sign(r)
+			if err := k.Verify(r); err != nil {
+				t.Errorf("Verify() after failed reload: %v", err)
+			}
+		})
+	}
+}
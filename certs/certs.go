@@ -0,0 +1,216 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+//
+// Package loads the certificate, key and certificate authority used for TLS
+// by timeserver and authserver, and reloads them when the files change so
+// that certificates can be rotated without a restart. Configs returned by a
+// Reloader always use the most recently loaded files, including for
+// verifying peers against the CA.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	log "github.com/cihub/seelog"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoCerts    = errors.New("certs: No certificates found in CA file.")
+	ErrNoPeerCert = errors.New("certs: Peer presented no certificate.")
+)
+
+// Holds certificate and CA pool loaded from files. Either may be
+// absent: a client need not present a certificate, and a Reloader
+// without a CA verifies peers against the system roots.
+type Reloader struct {
+	sync.RWMutex
+	certFile string
+	keyFile  string
+	caFile   string
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modified map[string]time.Time
+}
+
+// Returns reloader with files loaded. Cert and key must be given
+// together; any may be empty.
+func NewReloader(certFile string, keyFile string, caFile string) (r *Reloader, err error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("certs: Certificate and key must be given together.")
+	}
+	r = &Reloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err = r.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Loads files again. Previously loaded certificate and pool are kept
+// if any file fails to load.
+func (r *Reloader) Reload() (err error) {
+	modified := make(map[string]time.Time)
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file == "" {
+			continue
+		}
+		var info os.FileInfo
+		if info, err = os.Stat(file); err != nil {
+			return
+		}
+		modified[file] = info.ModTime()
+	}
+
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		var loaded tls.Certificate
+		if loaded, err = tls.LoadX509KeyPair(r.certFile, r.keyFile); err != nil {
+			return
+		}
+		cert = &loaded
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		var pem []byte
+		if pem, err = os.ReadFile(r.caFile); err != nil {
+			return
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return ErrNoCerts
+		}
+	}
+
+	r.Lock()
+	r.cert, r.pool, r.modified = cert, pool, modified
+	r.Unlock()
+	log.Info("certs: Loaded certificates.")
+	return
+}
+
+// Checks files every interval and reloads them if any has changed.
+// Runs until stop is closed.
+func (r *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				log.Error("certs: Keeping previous certificates: ", err)
+			}
+		}
+	}
+}
+
+func (r *Reloader) changed() bool {
+	r.RLock()
+	defer r.RUnlock()
+	for file, modified := range r.modified {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(modified) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reloader) certificate() *tls.Certificate {
+	r.RLock()
+	defer r.RUnlock()
+	if r.cert == nil {
+		return &tls.Certificate{}
+	}
+	return r.cert
+}
+
+// Returns CA pool, nil if none was given.
+func (r *Reloader) Pool() *x509.CertPool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.pool
+}
+
+// Returns config for a server presenting the loaded certificate. If
+// a CA was given, clients are asked for a certificate which, when
+// presented, must be signed by the CA; clientRequired refuses clients
+// without one. Peer certificates in the connection state are thus
+// always verified; see Verified().
+func (r *Reloader) ServerConfig(clientRequired bool) *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.certificate(), nil
+		},
+	}
+	if r.Pool() == nil {
+		return config
+	}
+
+	// Verified here rather than with ClientCAs so that a reloaded
+	// CA takes effect.
+	config.ClientAuth = tls.RequestClientCert
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			if clientRequired {
+				return ErrNoPeerCert
+			}
+			return nil
+		}
+		return r.verify(cs.PeerCertificates, "", x509.ExtKeyUsageClientAuth)
+	}
+	return config
+}
+
+// Returns true if the peer presented a certificate, which servers
+// configured by ServerConfig() will have verified.
+func Verified(cs *tls.ConnectionState) bool {
+	return cs != nil && len(cs.PeerCertificates) > 0
+}
+
+// Returns config for a client presenting the loaded certificate, if
+// any, and verifying the server against the CA. Verification is done
+// in VerifyConnection so that a reloaded CA takes effect.
+func (r *Reloader) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.certificate(), nil
+		},
+
+		// Standard verification is replaced, not skipped.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return ErrNoPeerCert
+			}
+			return r.verify(cs.PeerCertificates, cs.ServerName, x509.ExtKeyUsageServerAuth)
+		},
+	}
+}
+
+// Verifies chain against the CA, or system roots if none was given.
+func (r *Reloader) verify(chain []*x509.Certificate, name string, usage x509.ExtKeyUsage) (err error) {
+	opts := x509.VerifyOptions{
+		Roots:         r.Pool(),
+		DNSName:       name,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, cert := range chain[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err = chain[0].Verify(opts)
+	return
+}
@@ -0,0 +1,210 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package certs
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/patkaehuaea/command/certs/certstest"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// Starts server over TLS configured by config, answering whether
+// the client presented a verified certificate.
+func serveTLS(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Verified(r.TLS) {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	srv.Listener = tls.NewListener(srv.Listener, config)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return "https://" + srv.Listener.Addr().String()
+}
+
+func newReloader(t *testing.T, certFile string, keyFile string, caFile string) *Reloader {
+	t.Helper()
+	r, err := NewReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := certstest.NewCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, serverKey, err := ca.Issue("server", x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, clientKey, err := ca.Issue("client", x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rogue, err := certstest.NewCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rogueCert, rogueKey, err := rogue.Issue("rogue", x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newReloader(t, serverCert, serverKey, ca.File)
+	clients := map[string]*Reloader{
+		"none":     newReloader(t, "", "", ca.File),
+		"client":   newReloader(t, clientCert, clientKey, ca.File),
+		"server":   newReloader(t, serverCert, serverKey, ca.File),
+		"rogue CA": newReloader(t, rogueCert, rogueKey, ca.File),
+	}
+
+	tests := []struct {
+		client         string
+		clientRequired bool
+		want           int
+	}{
+		{"none", false, http.StatusForbidden},
+		{"none", true, 0},
+		{"client", false, http.StatusOK},
+		{"client", true, http.StatusOK},
+		{"server", false, 0},
+		{"rogue CA", false, 0},
+	}
+	for _, test := range tests {
+		name := test.client
+		if test.clientRequired {
+			name += " required"
+		}
+		t.Run(name, func(t *testing.T) {
+			url := serveTLS(t, server.ServerConfig(test.clientRequired))
+			c := &http.Client{Transport: &http.Transport{TLSClientConfig: clients[test.client].ClientConfig()}}
+			resp, err := c.Get(url)
+			if test.want == 0 {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("handshake succeeded with status %d, want failure", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, test.want)
+			}
+		})
+	}
+}
+
+func TestClientConfigRejectsUnknownServer(t *testing.T) {
+	ca, err := certstest.NewCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rogue, err := certstest.NewCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, serverKey, err := rogue.Issue("server", x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := serveTLS(t, newReloader(t, serverCert, serverKey, "").ServerConfig(false))
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: newReloader(t, "", "", ca.File).ClientConfig()}}
+	if resp, err := c.Get(url); err == nil {
+		resp.Body.Close()
+		t.Fatal("connected to server signed by another CA")
+	}
+}
+
+func TestReload(t *testing.T) {
+	ca, err := certstest.NewCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile, err := ca.Issue("server", x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newReloader(t, certFile, keyFile, ca.File)
+	first := r.certificate().Certificate[0]
+
+	// Rewritten files are kept until reloaded.
+	if _, _, err = ca.Issue("server", x509.ExtKeyUsageServerAuth); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(r.certificate().Certificate[0], first) {
+		t.Fatal("certificate changed before reload")
+	}
+	if err = r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	second := r.certificate().Certificate[0]
+	if bytes.Equal(second, first) {
+		t.Fatal("Reload() kept previous certificate")
+	}
+
+	// A broken key leaves the previous pair in use.
+	if err = os.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Reload(); err == nil {
+		t.Fatal("Reload() accepted broken key")
+	}
+	if !bytes.Equal(r.certificate().Certificate[0], second) {
+		t.Fatal("failed Reload() replaced certificate")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ca, err := certstest.NewCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile, err := ca.Issue("server", x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newReloader(t, certFile, keyFile, ca.File)
+	first := r.certificate().Certificate[0]
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.Watch(10*time.Millisecond, stop)
+
+	if _, _, err = ca.Issue("server", x509.ExtKeyUsageServerAuth); err != nil {
+		t.Fatal(err)
+	}
+	// Modification times may not move on filesystems with coarse
+	// timestamps.
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{certFile, keyFile} {
+		if err = os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for bytes.Equal(r.certificate().Certificate[0], first) {
+		if time.Now().After(deadline) {
+			t.Fatal("Watch() did not pick up rewritten certificate")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
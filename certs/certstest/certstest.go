@@ -0,0 +1,105 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+//
+// Package generates a certificate authority and certificates signed by it
+// for tests of TLS between timeserver and authserver, in the manner of
+// net/http/httptest. Certificates are written as PEM files, as the servers
+// read them, and are valid for localhost and 127.0.0.1 for one day.
+package certstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const VALIDITY = 24 * time.Hour
+
+// Certificate authority whose certificate is written to File.
+type CA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+	File string
+}
+
+// Returns new CA writing its certificate, and those it issues, to dir.
+func NewCA(dir string) (ca *CA, err error) {
+	var key *ecdsa.PrivateKey
+	if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial(),
+		Subject:               pkix.Name{CommonName: "certstest CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(VALIDITY),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	var der []byte
+	if der, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key); err != nil {
+		return
+	}
+	ca = &CA{key: key, dir: dir, File: filepath.Join(dir, "ca.pem")}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		return nil, err
+	}
+	if err = writePEM(ca.File, "CERTIFICATE", der); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Issues certificate named name for usages, such as
+// x509.ExtKeyUsageServerAuth, writing it to name.pem and its key to
+// name.key. Files already issued under name are replaced.
+func (ca *CA) Issue(name string, usages ...x509.ExtKeyUsage) (certFile string, keyFile string, err error) {
+	var key *ecdsa.PrivateKey
+	if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial(),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(VALIDITY),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  usages,
+	}
+	var der, keyDER []byte
+	if der, err = x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key); err != nil {
+		return
+	}
+	if keyDER, err = x509.MarshalECPrivateKey(key); err != nil {
+		return
+	}
+	certFile, keyFile = filepath.Join(ca.dir, name+".pem"), filepath.Join(ca.dir, name+".key")
+	if err = writePEM(certFile, "CERTIFICATE", der); err != nil {
+		return
+	}
+	err = writePEM(keyFile, "EC PRIVATE KEY", keyDER)
+	return
+}
+
+func serial() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	return n
+}
+
+func writePEM(file string, kind string, der []byte) error {
+	return os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600)
+}
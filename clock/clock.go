@@ -0,0 +1,79 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+//
+// Package abstracts the passage of time for timeserver and authserver. Code
+// that serves the time, simulates delay or runs on a schedule asks a Clock
+// rather than calling time.Now, time.Sleep or time.NewTicker directly. The
+// real clock may be pinned with Fixed() or shifted with Offset() so QA can
+// control the time served, and Fake gives tests a clock that only moves when
+// told to. Latency measurements should keep using the time package as they
+// must reflect real elapsed time.
+package clock
+
+import (
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Subset of time.Ticker behaviour. Channel is exposed through a
+// method so that fakes can provide their own.
+type Ticker interface {
+	C() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// Clock backed by the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// Clock whose Now() always returns the same instant. Sleeping and
+// tickers are left to base so that delays still take effect.
+type fixedClock struct {
+	Clock
+	at time.Time
+}
+
+func Fixed(base Clock, at time.Time) Clock {
+	return fixedClock{Clock: base, at: at}
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.at
+}
+
+// Clock running at the rate of base but shifted by offset.
+type offsetClock struct {
+	Clock
+	offset time.Duration
+}
+
+func Offset(base Clock, offset time.Duration) Clock {
+	return offsetClock{Clock: base, offset: offset}
+}
+
+func (c offsetClock) Now() time.Time {
+	return c.Clock.Now().Add(c.offset)
+}
@@ -0,0 +1,126 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Date(2015, 3, 8, 9, 59, 30, 0, time.UTC)
+
+func TestFixed(t *testing.T) {
+	f := NewFake(start)
+	c := Fixed(f, start.Add(time.Hour))
+	f.Advance(time.Minute)
+	if got := c.Now(); !got.Equal(start.Add(time.Hour)) {
+		t.Errorf("Now() = %v, want %v", got, start.Add(time.Hour))
+	}
+
+	// Delays still follow the base clock.
+	after := c.After(time.Second)
+	f.Advance(time.Second)
+	select {
+	case <-after:
+	default:
+		t.Error("After() did not fire once base clock advanced")
+	}
+}
+
+func TestOffset(t *testing.T) {
+	f := NewFake(start)
+	c := Offset(f, -90*time.Minute)
+	f.Advance(time.Minute)
+	if got, want := c.Now(), start.Add(-89*time.Minute); !got.Equal(want) {
+		t.Errorf("Now() = %v, want %v", got, want)
+	}
+}
+
+func TestFakeAfter(t *testing.T) {
+	f := NewFake(start)
+	after := f.After(time.Second)
+	if f.Waiters() != 1 {
+		t.Fatalf("Waiters() = %d, want 1", f.Waiters())
+	}
+
+	f.Advance(time.Second - time.Nanosecond)
+	select {
+	case <-after:
+		t.Fatal("After() fired early")
+	default:
+	}
+
+	f.Advance(time.Nanosecond)
+	select {
+	case at := <-after:
+		if !at.Equal(start.Add(time.Second)) {
+			t.Errorf("After() sent %v, want %v", at, start.Add(time.Second))
+		}
+	default:
+		t.Fatal("After() did not fire")
+	}
+	if f.Waiters() != 0 {
+		t.Errorf("Waiters() = %d after firing, want 0", f.Waiters())
+	}
+}
+
+func TestFakeSleep(t *testing.T) {
+	f := NewFake(start)
+	woke := make(chan struct{})
+	go func() {
+		f.Sleep(time.Minute)
+		close(woke)
+	}()
+	for f.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	f.Advance(time.Minute)
+	select {
+	case <-woke:
+	case <-time.After(time.Second):
+		t.Fatal("Sleep() did not return once time advanced")
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(start)
+	ticker := f.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for i := 1; i <= 3; i++ {
+		f.Advance(time.Second)
+		select {
+		case at := <-ticker.C():
+			if want := start.Add(time.Duration(i) * time.Second); !at.Equal(want) {
+				t.Errorf("tick %d at %v, want %v", i, at, want)
+			}
+		default:
+			t.Fatalf("tick %d missing", i)
+		}
+	}
+
+	// Ticks are dropped while the receiver falls behind.
+	f.Advance(5 * time.Second)
+	<-ticker.C()
+	select {
+	case <-ticker.C():
+		t.Error("ticker buffered more than one tick")
+	default:
+	}
+
+	ticker.Reset(time.Minute)
+	f.Advance(time.Second)
+	select {
+	case <-ticker.C():
+		t.Error("ticker fired at old interval after Reset()")
+	default:
+	}
+
+	ticker.Stop()
+	if f.Waiters() != 0 {
+		t.Errorf("Waiters() = %d after Stop(), want 0", f.Waiters())
+	}
+}
@@ -0,0 +1,141 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Deterministic clock for tests. Time stands still until Advance() or
+// Set() is called, at which point sleepers and tickers due in the
+// interval are woken in order.
+type Fake struct {
+	sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+// Pending wake-up. Period is zero for one-shot waiters created by
+// After() and Sleep().
+type waiter struct {
+	when   time.Time
+	period time.Duration
+	ch     chan time.Time
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.now
+}
+
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.After(d)
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	w := &waiter{ch: make(chan time.Time, 1)}
+	f.Lock()
+	defer f.Unlock()
+	w.when = f.now.Add(d)
+	if d <= 0 {
+		w.ch <- f.now
+		return w.ch
+	}
+	f.waiters = append(f.waiters, w)
+	return w.ch
+}
+
+// Ticker channel has a buffer of one; as with time.Ticker, ticks
+// are dropped if the receiver falls behind.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	w := &waiter{period: d, ch: make(chan time.Time, 1)}
+	f.Lock()
+	defer f.Unlock()
+	w.when = f.now.Add(d)
+	f.waiters = append(f.waiters, w)
+	return &fakeTicker{fake: f, w: w}
+}
+
+// Moves time forward by d.
+func (f *Fake) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Moves time to t, firing every waiter due at or before t in order
+// of when it was due. Setting time backwards fires nothing.
+func (f *Fake) Set(t time.Time) {
+	f.Lock()
+	defer f.Unlock()
+	for {
+		sort.SliceStable(f.waiters, func(i, j int) bool { return f.waiters[i].when.Before(f.waiters[j].when) })
+		if len(f.waiters) == 0 || f.waiters[0].when.After(t) {
+			break
+		}
+		w := f.waiters[0]
+		f.now = w.when
+		select {
+		case w.ch <- w.when:
+		default:
+		}
+		if w.period > 0 {
+			w.when = w.when.Add(w.period)
+		} else {
+			f.waiters = f.waiters[1:]
+		}
+	}
+	f.now = t
+}
+
+// Returns number of sleepers and tickers waiting. Lets a test wait
+// until the code under test has blocked before advancing time.
+func (f *Fake) Waiters() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.waiters)
+}
+
+func (f *Fake) remove(w *waiter) {
+	f.Lock()
+	defer f.Unlock()
+	for i, other := range f.waiters {
+		if other == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+type fakeTicker struct {
+	fake *Fake
+	w    *waiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.w.ch
+}
+
+func (t *fakeTicker) Reset(d time.Duration) {
+	t.fake.remove(t.w)
+	t.fake.Lock()
+	defer t.fake.Unlock()
+	t.w.period = d
+	t.w.when = t.fake.now.Add(d)
+	t.fake.waiters = append(t.fake.waiters, t.w)
+}
+
+func (t *fakeTicker) Stop() {
+	t.fake.remove(t.w)
+}
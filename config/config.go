@@ -4,68 +4,231 @@
 //  Written by Pat Kaehuaea, February 2015
 //
 // Wraps command line parsing and log initialization for timeserver and authserver.
-// Flag parameters exposed as package exports. Defaults for all flags defined in this
-// package.
+// Flag parameters exposed as package exports, parsed when main() calls Parse().
+// Defaults for all flags defined in this package.
 package config
 
 import (
 	"flag"
 	log "github.com/cihub/seelog"
+	"github.com/patkaehuaea/command/clock"
 	"os"
 	"path/filepath"
 	"time"
 )
 
 const (
+	ADMIN_PORT       = ""
 	AUTH_HOST        = "localhost"
+	AUTH_BACKOFF     = 50 * time.Millisecond
+	AUTH_BALANCE     = "round-robin"
+	AUTH_CA          = ""
+	AUTH_CERT        = ""
+	AUTH_DIAL_TIME   = 2 * time.Second
+	AUTH_EJECT_AFTER = 3
+	AUTH_EJECT_TIME  = 10 * time.Second
+	AUTH_ENDPOINTS   = ""
+	AUTH_ENDPT_FILE  = ""
+	AUTH_IDLE_TIME   = 90 * time.Second
+	AUTH_KEY         = ""
+	AUTH_MAX_IDLE    = 64
 	AUTH_PORT        = ":9080"
+	AUTH_PROTOCOL    = "http1"
+	AUTH_RESOLVE     = 30 * time.Second
+	AUTH_RETRIES     = 2
+	AUTH_SRV         = ""
+	AUTH_TLS_TIME    = 5 * time.Second
 	AUTH_TIMEOUT_MS  = 1000 * time.Millisecond
 	AVG_RESP_MS      = 1000 * time.Millisecond
+	BREAKER_COOLDOWN = 10 * time.Second
+	BREAKER_THRESH   = 5
+	CERT_RELOAD      = 10 * time.Second
 	CHECKPOINT_INT   = 60 * time.Second
 	DEV_MS           = 100 * time.Millisecond
 	DUMP_FILE        = ""
+	FAULT_PROFILES   = ""
+	FIXED_TIME       = ""
+	HSTS_MAX_AGE     = 365 * 24 * time.Hour
 	MAX_IN_FLIGHT    = 0
+	MAX_SUBSCRIBERS  = 100
+	NAME_CACHE_NEG   = 10 * time.Second
+	NAME_CACHE_SIZE  = 10000
+	NAME_CACHE_STALE = 0 * time.Second
+	NAME_CACHE_TTL   = 1 * time.Minute
+	REDIRECT_PORT    = ""
+	REPLICA_MAX_LAG  = 30 * time.Second
+	REPLICATE_FROM   = ""
+	REPL_CERT        = ""
+	REPL_KEY         = ""
+	REPL_LOG_SIZE    = 10000
+	REQUEST_TIMEOUT  = 0 * time.Second
+	SERVICE_KEYS     = ""
+	SIMULATE_HEADERS = false
+	TIME_OFFSET      = 0 * time.Second
 	TIME_PORT        = ":8080"
 	SEELOG_CONF_DIR  = "etc"
 	SEELOG_CONF_FILE = "seelog.xml"
+	SNTP_BURST       = 4
+	SNTP_PORT        = ""
+	SNTP_RATE        = 1.0
+	SNTP_STRATUM     = 1
+	STREAM_HEARTBEAT = 15 * time.Second
+	STREAM_INTERVAL  = 1 * time.Second
+	TLS_CERT         = ""
+	TLS_KEY          = ""
 	TMPL_DIR         = "templates"
+	WORLDCLOCK_ZONES = "America/Los_Angeles,America/New_York,Europe/London,Asia/Tokyo"
 )
 
 var (
+	AdminPort     *string
+	AuthAdminPort *string
+	AuthBackoff   *time.Duration
+	AuthBalance   *string
+	AuthCA        *string
+	AuthCert      *string
+	AuthDialTime  *time.Duration
+	AuthEjectAt   *int
+	AuthEjectTime *time.Duration
+	AuthEndpoints *string
+	AuthEndptFile *string
 	AuthHost      *string
+	AuthIdleTime  *time.Duration
+	AuthKey       *string
+	AuthMaxIdle   *int
 	AuthPort      *string
+	AuthProtocol  *string
+	AuthResolve   *time.Duration
+	AuthRetries   *int
+	AuthSRV       *string
 	AuthTimeoutMS *time.Duration
+	AuthTLSTime   *time.Duration
 	AvgRespMS     *time.Duration
+	BreakerCool   *time.Duration
+	BreakerThresh *int
+	CertReload    *time.Duration
 	DeviationMS   *time.Duration
 	DumpFile      *string
+	FaultProfiles *string
+	HSTSMaxAge    *time.Duration
 	CheckpointInt *time.Duration
 	MaxInFlight   *int
+	MaxSubs       *int
+	NameCacheNeg  *time.Duration
+	NameCacheSize *int
+	NameStale     *time.Duration
+	NameCacheTTL  *time.Duration
+	RedirectPort  *string
+	ReplicaMaxLag *time.Duration
+	ReplicateFrom *string
+	ReplCert      *string
+	ReplKey       *string
+	ReplLogSize   *int
+	ReqTimeout    *time.Duration
+	ServiceKeys   *string
+	SimHeaders    *bool
+	SNTPBurst     *int
+	SNTPPort      *string
+	SNTPRate      *float64
+	SNTPStratum   *int
+	StreamBeat    *time.Duration
+	StreamInt     *time.Duration
+	TimeOffset    *time.Duration
 	TimePort      *string
+	TLSCert       *string
+	TLSKey        *string
 	TmplDir       *string
 	Verbose       *bool
+	WorldZones    *string
 	Logger        log.LoggerInterface
+
+	// Source of the current time for both servers; see --fixed-time
+	// and --time-offset.
+	Clock clock.Clock = clock.Real
+)
+
+// Read only by Parse().
+var (
+	fixedTime *string
+	logConf   *string
 )
 
 func init() {
 	// Parameters for timeserver:
+	AdminPort = flag.String("admin-port", ADMIN_PORT, "Serve /metrics on this port rather than --port when set, and /faults only then.")
 	AuthHost = flag.String("authhost", AUTH_HOST, "Hostname of downstream authentication server.")
 	AuthTimeoutMS = flag.Duration("authtimeout-ms", AUTH_TIMEOUT_MS, "Milliseconds to wait before terminating downstream auth request.")
+	AuthBackoff = flag.Duration("auth-backoff", AUTH_BACKOFF, "Wait before first retry of a failed authserver lookup; doubles with each retry.")
+	AuthDialTime = flag.Duration("auth-dial-timeout", AUTH_DIAL_TIME, "Time to wait for a connection to authserver.")
+	AuthIdleTime = flag.Duration("auth-idle-timeout", AUTH_IDLE_TIME, "Time an idle connection to authserver is kept for reuse.")
+	AuthMaxIdle = flag.Int("auth-max-idle", AUTH_MAX_IDLE, "Idle connections to authserver kept for reuse.")
+	AuthTLSTime = flag.Duration("auth-tls-timeout", AUTH_TLS_TIME, "Time to wait for a TLS handshake with authserver.")
+	AuthRetries = flag.Int("auth-retries", AUTH_RETRIES, "Times a failed authserver lookup is retried.")
+	AuthEndpoints = flag.String("auth-endpoints", AUTH_ENDPOINTS, "Comma separated host:port of authservers to spread calls across, replacing --authhost and --authport.")
+	AuthEndptFile = flag.String("auth-endpoints-file", AUTH_ENDPT_FILE, "File of authserver host:port, one per line, reread every --auth-resolve-interval.")
+	AuthSRV = flag.String("auth-srv", AUTH_SRV, "DNS SRV name, e.g. _auth._tcp.example.com, listing authservers; looked up every --auth-resolve-interval.")
+	AuthResolve = flag.Duration("auth-resolve-interval", AUTH_RESOLVE, "Period between lookups of --auth-endpoints-file or --auth-srv.")
+	AuthBalance = flag.String("auth-balance", AUTH_BALANCE, "How calls are spread across authservers: round-robin or least-outstanding.")
+	AuthEjectAt = flag.Int("auth-eject-after", AUTH_EJECT_AFTER, "Consecutive failures after which an authserver is ejected, zero to never eject.")
+	AuthEjectTime = flag.Duration("auth-eject-time", AUTH_EJECT_TIME, "Time an ejected authserver is avoided.")
+	BreakerCool = flag.Duration("auth-breaker-cooldown", BREAKER_COOLDOWN, "Time calls to authserver fail fast once the circuit breaker opens.")
+	BreakerThresh = flag.Int("auth-breaker-threshold", BREAKER_THRESH, "Consecutive authserver failures that open the circuit breaker, zero to disable.")
 	AvgRespMS = flag.Duration("avg-response-ms", AVG_RESP_MS, "Average time to delay response to upstream time request.")
 	DeviationMS = flag.Duration("deviation-ms", DEV_MS, "Average standard deviation in response delay to upstream time request.")
+	FaultProfiles = flag.String("fault-profiles", FAULT_PROFILES, "JSON file of fault profiles and the routes they apply to.")
+	HSTSMaxAge = flag.Duration("hsts-max-age", HSTS_MAX_AGE, "Time browsers should only use HTTPS once told by Strict-Transport-Security, zero to omit the header.")
 	MaxInFlight = flag.Int("max-inflight", MAX_IN_FLIGHT, "Maximum number of in-flight time requests the timeserver can handle.")
+	MaxSubs = flag.Int("max-subscribers", MAX_SUBSCRIBERS, "Maximum number of clients subscribed to /time/stream, zero for no limit.")
+	NameCacheNeg = flag.Duration("name-cache-negative-ttl", NAME_CACHE_NEG, "Time a failed lookup of a user's name is cached.")
+	NameCacheSize = flag.Int("name-cache-size", NAME_CACHE_SIZE, "Users whose names are cached, zero to disable the cache.")
+	NameStale = flag.Duration("name-cache-stale", NAME_CACHE_STALE, "Time an expired name may still be served while it is refreshed in the background, zero to disable.")
+	NameCacheTTL = flag.Duration("name-cache-ttl", NAME_CACHE_TTL, "Time a user's name is cached.")
+	RedirectPort = flag.String("redirect-port", REDIRECT_PORT, "Redirect plain HTTP on this port to HTTPS when --tls-cert is set.")
+	ReqTimeout = flag.Duration("request-timeout", REQUEST_TIMEOUT, "Budget for serving a request, simulated delay and calls to authserver included, zero for none.")
+	SimHeaders = flag.Bool("simulate-headers", SIMULATE_HEADERS, "Honour X-Simulate-Delay, X-Simulate-Status and X-Simulate-Auth-Failure request headers. Never enable in production.")
+	SNTPBurst = flag.Int("sntp-burst", SNTP_BURST, "SNTP requests a client may send in a burst before being rate limited.")
+	SNTPPort = flag.String("sntp-port", SNTP_PORT, "Serve SNTP on this UDP port, e.g. :123, when set.")
+	SNTPRate = flag.Float64("sntp-rate", SNTP_RATE, "SNTP requests per second allowed from each client, zero for no limit.")
+	SNTPStratum = flag.Int("sntp-stratum", SNTP_STRATUM, "Stratum advertised in SNTP responses.")
+	StreamBeat = flag.Duration("stream-heartbeat", STREAM_HEARTBEAT, "Idle period after which a heartbeat is sent to /time/stream clients.")
+	StreamInt = flag.Duration("stream-interval", STREAM_INTERVAL, "Period between times pushed to /time/stream clients.")
 	TimePort = flag.String("port", TIME_PORT, "Time server binds to this port.")
+	TLSCert = flag.String("tls-cert", TLS_CERT, "PEM certificate; serve HTTPS on --port when set.")
+	TLSKey = flag.String("tls-key", TLS_KEY, "PEM private key for --tls-cert.")
 	TmplDir = flag.String("templates", TMPL_DIR, "Directory relative to executable where templates are stored.")
 	Verbose = flag.Bool("V", false, "Prints version number of program.")
+	WorldZones = flag.String("worldclock-zones", WORLDCLOCK_ZONES, "Comma separated IANA zones always shown on /worldclock.")
 
 	// Parameters for authserver:
+	AuthAdminPort = flag.String("authadmin-port", ADMIN_PORT, "Serve /metrics on this port rather than --authport when set, and /promote only then.")
 	DumpFile = flag.String("dumpfile", DUMP_FILE, "Name of file storing state as JSON document.")
 	CheckpointInt = flag.Duration("checkpoint-interval", CHECKPOINT_INT, "Dump state to file every checkpoint-interval seconds.")
+	ReplicateFrom = flag.String("replicate-from", REPLICATE_FROM, "Base URL of primary authserver, e.g. http://auth1:9080, to follow as a read-only replica.")
+	ReplLogSize = flag.Int("replication-log-size", REPL_LOG_SIZE, "Recent changes kept for followers to catch up from without a new snapshot.")
+	ReplicaMaxLag = flag.Duration("replica-max-lag", REPLICA_MAX_LAG, "Time without hearing from the primary after which a follower reports not ready.")
+	ReplCert = flag.String("replication-cert", REPL_CERT, "PEM client certificate a follower presents to an https primary, verified against --auth-ca.")
+	ReplKey = flag.String("replication-key", REPL_KEY, "PEM private key for --replication-cert.")
 
 	// Shared parameters:
 	AuthPort = flag.String("authport", AUTH_PORT, "Auth server binds to this port.")
+	AuthCA = flag.String("auth-ca", AUTH_CA, "PEM file of CA that signed the other server's certificate. Enables TLS between the servers.")
+	AuthCert = flag.String("auth-cert", AUTH_CERT, "PEM certificate this server presents to the other: server certificate for authserver, client certificate for timeserver.")
+	AuthKey = flag.String("auth-key", AUTH_KEY, "PEM private key for --auth-cert.")
+	CertReload = flag.Duration("cert-reload", CERT_RELOAD, "Period between checks of certificate and service key files for changes.")
+	ServiceKeys = flag.String("service-keys", SERVICE_KEYS, "File of \"id secret\" lines signing requests to authserver; the first key signs, all verify.")
+	AuthProtocol = flag.String("auth-protocol", AUTH_PROTOCOL, "Protocol between timeserver and authserver: http1, h2c or h2 (HTTP/2 over TLS).")
+	fixedTime = flag.String("fixed-time", FIXED_TIME, "Serve this RFC 3339 time, e.g. 2015-03-01T12:00:00Z, rather than the system clock.")
+	TimeOffset = flag.Duration("time-offset", TIME_OFFSET, "Shift the system clock by this duration, e.g. -90m, before serving it.")
 
 	// Local parameters:
-	logConf := flag.String("log", SEELOG_CONF_FILE, "Name of log configuration file in etc directory relative to executable.")
+	logConf = flag.String("log", SEELOG_CONF_FILE, "Name of log configuration file in etc directory relative to executable.")
+
+}
+
+// Parses the command line, then loads the log configuration and sets
+// up Clock. Called first thing from main(); tests leave flags to the
+// testing package and flag.Set() any they need.
+func Parse() {
 
 	flag.Parse()
 
@@ -76,4 +239,17 @@ func init() {
 	if Logger, err = log.LoggerFromConfigAsFile(filepath.Join(cwd, SEELOG_CONF_DIR, *logConf)); err != nil {
 		log.Warn(err)
 	}
+
+	if *fixedTime != "" {
+		var at time.Time
+		if at, err = time.Parse(time.RFC3339Nano, *fixedTime); err != nil {
+			log.Critical("config: --fixed-time must be an RFC 3339 time: ", err)
+			log.Flush()
+			os.Exit(1)
+		}
+		Clock = clock.Fixed(Clock, at)
+	}
+	if *TimeOffset != 0 {
+		Clock = clock.Offset(Clock, *TimeOffset)
+	}
 }
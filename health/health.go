@@ -0,0 +1,133 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+//
+// Package provides liveness and readiness reporting shared by timeserver and
+// authserver. A Checker holds named dependency checks and serves their
+// combined result as a JSON document. Checks that are expensive, such as a
+// call to another server, can be wrapped by Checker.Cached() so that frequent
+// probes do not turn into frequent downstream requests.
+package health
+
+import (
+	"encoding/json"
+	log "github.com/cihub/seelog"
+	"github.com/patkaehuaea/command/clock"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	STATUS_OK          = "ok"
+	STATUS_UNAVAILABLE = "unavailable"
+)
+
+// Returns detail describing the dependency and non-nil error
+// if the dependency is not usable.
+type Check func() (detail string, err error)
+
+type Result struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status  string            `json:"status"`
+	Version string            `json:"version"`
+	Uptime  string            `json:"uptime"`
+	Checks  map[string]Result `json:"checks,omitempty"`
+}
+
+// Collection of named checks. Zero checks is always healthy, which
+// makes a Checker with none suitable as a liveness endpoint.
+type Checker struct {
+	sync.RWMutex
+	version string
+	started time.Time
+	checks  map[string]Check
+
+	// Expires results of Cached() checks. Defaults to clock.Real.
+	Clock clock.Clock
+}
+
+func NewChecker(version string) *Checker {
+	return &Checker{version: version, started: time.Now(), checks: make(map[string]Check), Clock: clock.Real}
+}
+
+func (c *Checker) Add(name string, check Check) {
+	c.Lock()
+	c.checks[name] = check
+	c.Unlock()
+}
+
+// Runs every check and returns combined report. Report status is
+// STATUS_OK only if every check passed.
+func (c *Checker) Run() (report Report) {
+	// Checks are copied so that they run without holding the lock.
+	type named struct {
+		name  string
+		check Check
+	}
+	c.RLock()
+	checks := make([]named, 0, len(c.checks))
+	for name, check := range c.checks {
+		checks = append(checks, named{name, check})
+	}
+	c.RUnlock()
+	sort.Slice(checks, func(i, j int) bool { return checks[i].name < checks[j].name })
+
+	report = Report{Status: STATUS_OK, Version: c.version, Uptime: time.Since(c.started).String()}
+	if len(checks) > 0 {
+		report.Checks = make(map[string]Result)
+	}
+	for _, n := range checks {
+		name := n.name
+		detail, err := n.check()
+		result := Result{Status: STATUS_OK, Detail: detail}
+		if err != nil {
+			result.Status = STATUS_UNAVAILABLE
+			result.Error = err.Error()
+			report.Status = STATUS_UNAVAILABLE
+		}
+		report.Checks[name] = result
+	}
+	return
+}
+
+// Writes report as JSON. Responds with 503 if any check failed so
+// that probes need not parse the body.
+func (c *Checker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := c.Run()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if report.Status != STATUS_OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Error(err)
+	}
+}
+
+// Returns check that reuses the result of check for ttl, as timed by
+// Clock, before running it again. Concurrent callers wait for a
+// single run.
+func (c *Checker) Cached(check Check, ttl time.Duration) Check {
+	var mu sync.Mutex
+	var detail string
+	var err error
+	var expires time.Time
+	return func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if c.Clock.Now().Before(expires) {
+			return detail, err
+		}
+		detail, err = check()
+		expires = c.Clock.Now().Add(ttl)
+		return detail, err
+	}
+}
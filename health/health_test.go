@@ -0,0 +1,81 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package health
+
+import (
+	"errors"
+	"github.com/patkaehuaea/command/clock"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCached(t *testing.T) {
+	const ttl = 5 * time.Second
+	f := clock.NewFake(time.Date(2015, 3, 8, 9, 59, 30, 0, time.UTC))
+	c := NewChecker("v1")
+	c.Clock = f
+
+	runs := 0
+	failing := false
+	check := c.Cached(func() (string, error) {
+		runs++
+		if failing {
+			return "down", errors.New("health: Dependency down.")
+		}
+		return "up", nil
+	}, ttl)
+
+	tests := []struct {
+		advance time.Duration
+		failing bool
+		runs    int
+		detail  string
+	}{
+		{0, false, 1, "up"},
+		{ttl - time.Nanosecond, true, 1, "up"},
+		{time.Nanosecond, true, 2, "down"},
+		{time.Second, false, 2, "down"},
+		{ttl, false, 3, "up"},
+	}
+	for i, test := range tests {
+		f.Advance(test.advance)
+		failing = test.failing
+		detail, _ := check()
+		if runs != test.runs || detail != test.detail {
+			t.Errorf("call %d: runs = %d, detail = %q; want %d, %q", i+1, runs, detail, test.runs, test.detail)
+		}
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	tests := []struct {
+		name   string
+		checks map[string]Check
+		code   int
+	}{
+		{"no checks", nil, http.StatusOK},
+		{"passing", map[string]Check{"a": func() (string, error) { return "", nil }}, http.StatusOK},
+		{"one failing", map[string]Check{
+			"a": func() (string, error) { return "", nil },
+			"b": func() (string, error) { return "", errors.New("health: Dependency down.") },
+		}, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewChecker("v1")
+			for name, check := range test.checks {
+				c.Add(name, check)
+			}
+			w := httptest.NewRecorder()
+			c.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+			if w.Code != test.code {
+				t.Errorf("status = %d, want %d", w.Code, test.code)
+			}
+		})
+	}
+}
@@ -18,8 +18,17 @@ else
     $GOPATH/bin/timeserver > /dev/null 2>&1 &
 fi
 
-if pgrep authserver > /dev/null 2>&1 && pgrep timeserver > /dev/null 2>&1 ; then
+# Give both servers a few seconds to report ready before tailing logs.
+for i in 1 2 3 4 5 ; do
+    if curl -sf localhost:9080/readyz > /dev/null 2>&1 && curl -sf localhost:8080/readyz > /dev/null 2>&1 ; then
+        READY=1
+        break
+    fi
+    sleep 1
+done
+
+if [ -n "$READY" ] ; then
     tail -f $GOPATH/src/github.com/patkaehuaea/command/*/out/*.log
 else
-    echo "Timeserver and/or authserver not running. Will not tail logs."
+    echo "Timeserver and/or authserver not ready. Will not tail logs."
 fi
\ No newline at end of file
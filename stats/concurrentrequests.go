@@ -0,0 +1,80 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, February 2015
+
+package stats
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+const (
+	START_VALUE = 0
+	MIN_VALUE   = 0
+	NO_LIMIT    = 0
+)
+
+// Errors are allocated once so rejecting a request costs no more
+// than the compare-and-swap that decided to reject it.
+var (
+	ErrMaxExceeded = errors.New("stats: Exceeded threshold of concurrent requests.")
+	ErrMinValue    = errors.New("stats: Count already at MIN_VALUE.")
+)
+
+// Tracks the number of requests currently being served. A max of
+// NO_LIMIT disables throttling while still keeping count. Safe for
+// concurrent use without locking.
+type ConcurrentRequests struct {
+	count    int64
+	rejected uint64
+	max      int64
+}
+
+func NewCR(max int) (cr *ConcurrentRequests) {
+	cr = &ConcurrentRequests{count: START_VALUE, max: int64(max)}
+	return
+}
+
+// Increments count unless doing so would exceed max. Error is
+// returned to caller when request should be rejected.
+func (cr *ConcurrentRequests) Add() (err error) {
+	for {
+		current := atomic.LoadInt64(&cr.count)
+		if cr.max != NO_LIMIT && current >= cr.max {
+			atomic.AddUint64(&cr.rejected, 1)
+			return ErrMaxExceeded
+		}
+		if atomic.CompareAndSwapInt64(&cr.count, current, current+1) {
+			return
+		}
+	}
+}
+
+func (cr *ConcurrentRequests) Current() (current int) {
+	current = int(atomic.LoadInt64(&cr.count))
+	return
+}
+
+// Returns configured limit, or NO_LIMIT if unthrottled.
+func (cr *ConcurrentRequests) Max() int {
+	return int(cr.max)
+}
+
+// Returns number of calls to Add() that were refused since creation.
+func (cr *ConcurrentRequests) Rejected() uint64 {
+	return atomic.LoadUint64(&cr.rejected)
+}
+
+func (cr *ConcurrentRequests) Subtract() (err error) {
+	for {
+		current := atomic.LoadInt64(&cr.count)
+		if current <= MIN_VALUE {
+			return ErrMinValue
+		}
+		if atomic.CompareAndSwapInt64(&cr.count, current, current-1) {
+			return
+		}
+	}
+}
@@ -0,0 +1,200 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+//
+// Package provides the metrics used by timeserver and authserver. Counters,
+// gauges and histograms are updated with atomic operations only so they can
+// stay enabled on every request. Labelled variants (CounterVec, HistogramVec)
+// take a lock only the first time a given set of label values is seen.
+package stats
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds, in seconds, of latency histogram buckets. Chosen to
+// cover both the sub-millisecond auth calls and the simulated delay
+// on /time which defaults to one second.
+var DEFAULT_BUCKETS = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Separates label values when building the key of a vector entry.
+const LABEL_SEPARATOR = "\xff"
+
+// Monotonically increasing count.
+type Counter struct {
+	value uint64
+}
+
+func NewCounter() *Counter {
+	return &Counter{}
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// Value that may go up and down, such as requests in flight.
+type Gauge struct {
+	value int64
+}
+
+func NewGauge() *Gauge {
+	return &Gauge{}
+}
+
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.value, 1)
+}
+
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.value, -1)
+}
+
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.value, v)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// Distribution of durations over fixed buckets. Sum is kept in
+// nanoseconds so that Observe() never needs more than atomic adds.
+type Histogram struct {
+	count  uint64
+	sum    int64
+	bounds []float64
+	counts []uint64
+}
+
+// Point in time copy of a histogram. Counts are cumulative, as
+// expected by the Prometheus exposition format, and the final
+// entry covers +Inf.
+type HistogramSnapshot struct {
+	Bounds []float64
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// Returns histogram with upper bounds in seconds. Bounds must be
+// sorted in increasing order.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(h.bounds, seconds)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// Convenience for deferred calls, e.g. defer h.ObserveSince(time.Now()).
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start))
+}
+
+func (h *Histogram) Snapshot() (s HistogramSnapshot) {
+	s.Bounds = h.bounds
+	s.Counts = make([]uint64, len(h.counts))
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		s.Counts[i] = cumulative
+	}
+	s.Count = atomic.LoadUint64(&h.count)
+	s.Sum = time.Duration(atomic.LoadInt64(&h.sum))
+	return
+}
+
+// Shared implementation of labelled metrics. Lookups of existing
+// entries go through sync.Map and do not block one another.
+type vec struct {
+	labels  []string
+	entries sync.Map
+	create  func() interface{}
+}
+
+func (v *vec) with(values []string) interface{} {
+	key := strings.Join(values, LABEL_SEPARATOR)
+	if m, ok := v.entries.Load(key); ok {
+		return m
+	}
+	m, _ := v.entries.LoadOrStore(key, v.create())
+	return m
+}
+
+// Calls fn for every entry in order of label values so output
+// is stable between calls.
+func (v *vec) each(fn func(values []string, m interface{})) {
+	var keys []string
+	v.entries.Range(func(k, _ interface{}) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	sort.Strings(keys)
+	for _, k := range keys {
+		m, _ := v.entries.Load(k)
+		fn(strings.Split(k, LABEL_SEPARATOR), m)
+	}
+}
+
+// Counters partitioned by label values, e.g. status code per route.
+type CounterVec struct {
+	vec
+}
+
+func NewCounterVec(labels ...string) *CounterVec {
+	return &CounterVec{vec{labels: labels, create: func() interface{} { return NewCounter() }}}
+}
+
+// Returns counter for label values, creating it if necessary. Values
+// must be passed in the same order as labels given to NewCounterVec.
+func (cv *CounterVec) With(values ...string) *Counter {
+	return cv.with(values).(*Counter)
+}
+
+func (cv *CounterVec) Labels() []string {
+	return cv.labels
+}
+
+func (cv *CounterVec) Each(fn func(values []string, c *Counter)) {
+	cv.each(func(values []string, m interface{}) { fn(values, m.(*Counter)) })
+}
+
+// Histograms partitioned by label values, e.g. latency per route.
+type HistogramVec struct {
+	vec
+}
+
+func NewHistogramVec(bounds []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{vec{labels: labels, create: func() interface{} { return NewHistogram(bounds) }}}
+}
+
+// Returns histogram for label values, creating it if necessary.
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	return hv.with(values).(*Histogram)
+}
+
+func (hv *HistogramVec) Labels() []string {
+	return hv.labels
+}
+
+func (hv *HistogramVec) Each(fn func(values []string, h *Histogram)) {
+	hv.each(func(values []string, m interface{}) { fn(values, m.(*Histogram)) })
+}
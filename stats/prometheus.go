@@ -0,0 +1,157 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	PROMETHEUS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+	COUNTER_TYPE            = "counter"
+	GAUGE_TYPE              = "gauge"
+	HISTOGRAM_TYPE          = "histogram"
+)
+
+// Escapes label values as required by the text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type family struct {
+	name  string
+	help  string
+	kind  string
+	write func(w *bufio.Writer, name string)
+}
+
+// Collection of metrics exposed together on a /metrics endpoint.
+// Metrics are written in the order they were registered.
+type Registry struct {
+	sync.Mutex
+	families []family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(name string, help string, kind string, write func(w *bufio.Writer, name string)) {
+	r.Lock()
+	r.families = append(r.families, family{name: name, help: help, kind: kind, write: write})
+	r.Unlock()
+}
+
+func (r *Registry) Counter(name string, help string, c *Counter) {
+	r.register(name, help, COUNTER_TYPE, func(w *bufio.Writer, name string) {
+		writeSample(w, name, nil, nil, float64(c.Value()))
+	})
+}
+
+// Registers counter whose value is read from fn at scrape time. Used
+// for counts already maintained elsewhere, e.g. throttle rejections.
+func (r *Registry) CounterFunc(name string, help string, fn func() float64) {
+	r.register(name, help, COUNTER_TYPE, func(w *bufio.Writer, name string) {
+		writeSample(w, name, nil, nil, fn())
+	})
+}
+
+func (r *Registry) CounterVec(name string, help string, cv *CounterVec) {
+	r.register(name, help, COUNTER_TYPE, func(w *bufio.Writer, name string) {
+		cv.Each(func(values []string, c *Counter) {
+			writeSample(w, name, cv.Labels(), values, float64(c.Value()))
+		})
+	})
+}
+
+func (r *Registry) Gauge(name string, help string, g *Gauge) {
+	r.register(name, help, GAUGE_TYPE, func(w *bufio.Writer, name string) {
+		writeSample(w, name, nil, nil, float64(g.Value()))
+	})
+}
+
+// Registers gauge whose value is read from fn at scrape time.
+func (r *Registry) GaugeFunc(name string, help string, fn func() float64) {
+	r.register(name, help, GAUGE_TYPE, func(w *bufio.Writer, name string) {
+		writeSample(w, name, nil, nil, fn())
+	})
+}
+
+func (r *Registry) Histogram(name string, help string, h *Histogram) {
+	r.register(name, help, HISTOGRAM_TYPE, func(w *bufio.Writer, name string) {
+		writeHistogram(w, name, nil, nil, h.Snapshot())
+	})
+}
+
+func (r *Registry) HistogramVec(name string, help string, hv *HistogramVec) {
+	r.register(name, help, HISTOGRAM_TYPE, func(w *bufio.Writer, name string) {
+		hv.Each(func(values []string, h *Histogram) {
+			writeHistogram(w, name, hv.Labels(), values, h.Snapshot())
+		})
+	})
+}
+
+// Writes every registered metric to out in Prometheus text format.
+func (r *Registry) Write(out io.Writer) (err error) {
+	r.Lock()
+	families := make([]family, len(r.families))
+	copy(families, r.families)
+	r.Unlock()
+
+	w := bufio.NewWriter(out)
+	for _, f := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+		f.write(w, f.name)
+	}
+	err = w.Flush()
+	return
+}
+
+// Allows registry to be mounted directly as the /metrics handler.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", PROMETHEUS_CONTENT_TYPE)
+	if err := r.Write(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeHistogram(w *bufio.Writer, name string, labels []string, values []string, s HistogramSnapshot) {
+	bucketLabels := append(append([]string{}, labels...), "le")
+	for i, bound := range s.Bounds {
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		writeSample(w, name+"_bucket", bucketLabels, append(append([]string{}, values...), le), float64(s.Counts[i]))
+	}
+	writeSample(w, name+"_bucket", bucketLabels, append(append([]string{}, values...), "+Inf"), float64(s.Counts[len(s.Bounds)]))
+	writeSample(w, name+"_sum", labels, values, s.Sum.Seconds())
+	writeSample(w, name+"_count", labels, values, float64(s.Count))
+}
+
+func writeSample(w *bufio.Writer, name string, labels []string, values []string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label)
+			w.WriteString(`="`)
+			if i < len(values) {
+				labelEscaper.WriteString(w, values[i])
+			}
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	w.WriteByte('\n')
+}
@@ -0,0 +1,136 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+//
+// Package formats times for display on the time page. A format is either one
+// of the named formats below or a custom Go layout such as "Jan 2 15:04".
+// Month and day names are translated for the locales in locales.go; Format()
+// substitutes them after Go has formatted everything else, so the layout
+// rules of the time package apply unchanged. Machine formats, iso8601 and
+// rfc1123, are always rendered in English so they still parse.
+package timefmt
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	FORMAT_12H     = "12h"
+	FORMAT_24H     = "24h"
+	FORMAT_ISO8601 = "iso8601"
+	FORMAT_RFC1123 = "rfc1123"
+	FORMAT_LONG    = "long"
+)
+
+// Layouts of named formats. Long format is the only named format
+// with month and day names spelled out in full.
+var layouts = map[string]string{
+	FORMAT_12H:     "3:04:05 PM",
+	FORMAT_24H:     "15:04:05",
+	FORMAT_ISO8601: "2006-01-02T15:04:05Z07:00",
+	FORMAT_RFC1123: time.RFC1123,
+	FORMAT_LONG:    "Monday, 2 January 2006 15:04:05",
+}
+
+// Named formats whose standards fix month and day names in English.
+var machine = map[string]bool{FORMAT_ISO8601: true, FORMAT_RFC1123: true}
+
+// Named formats in the order offered on the profile page.
+var NAMES = []string{FORMAT_12H, FORMAT_24H, FORMAT_ISO8601, FORMAT_RFC1123, FORMAT_LONG}
+
+// Placeholders written into layout in place of month and day
+// names. Go passes them through unchanged so they can be replaced
+// with translated names afterwards. Longer names must be replaced
+// first as "Jan" is a prefix of "January".
+var placeholders = []struct {
+	element     string
+	placeholder string
+}{
+	{"January", "\x01"},
+	{"Jan", "\x02"},
+	{"Monday", "\x03"},
+	{"Mon", "\x04"},
+}
+
+// Returns Go layout for format. Format that is not a named format is
+// treated as a custom layout and must contain at least one layout
+// element, otherwise every time would render as the same text.
+func Layout(format string) (layout string, err error) {
+	if layout, ok := layouts[format]; ok {
+		return layout, nil
+	}
+	// Second time differs from the first in every field, including
+	// weekday and AM/PM, so any layout element changes the output.
+	first := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+	second := time.Date(2007, time.March, 8, 4, 5, 6, 700000000, time.FixedZone("XST", 3600))
+	if format == "" || first.Format(format) == second.Format(format) {
+		err = fmt.Errorf("timefmt: %q is neither a named format (%s) nor a Go layout.", format, strings.Join(NAMES, ", "))
+		return
+	}
+	layout = format
+	return
+}
+
+// Returns true if format is empty, meaning no preference, or
+// is accepted by Layout().
+func IsValid(format string) bool {
+	if format == "" {
+		return true
+	}
+	_, err := Layout(format)
+	return err == nil
+}
+
+// Formats t according to format with month and day names in locale,
+// other than for machine formats. Unsupported locales fall back to
+// DEFAULT_LOCALE.
+func Format(t time.Time, format string, locale string) (formatted string, err error) {
+	var layout string
+	if layout, err = Layout(format); err != nil {
+		return
+	}
+	if machine[format] {
+		formatted = t.Format(layout)
+		return
+	}
+	names, ok := locales[locale]
+	if !ok {
+		names = locales[DEFAULT_LOCALE]
+	}
+
+	for _, p := range placeholders {
+		layout = strings.Replace(layout, p.element, p.placeholder, -1)
+	}
+	formatted = t.Format(layout)
+	formatted = strings.NewReplacer(
+		"\x01", names.months[t.Month()-1],
+		"\x02", names.shortMonths[t.Month()-1],
+		"\x03", names.days[t.Weekday()],
+		"\x04", names.shortDays[t.Weekday()],
+	).Replace(formatted)
+	return
+}
+
+// Returns format used when user has no preference. English speakers
+// are shown a 12 hour clock, everyone else a 24 hour clock.
+func DefaultFormat(locale string) string {
+	if locale == "en" {
+		return FORMAT_12H
+	}
+	return FORMAT_24H
+}
+
+// Returns true if format includes the zone name or offset, in which
+// case callers need not label the formatted time with its zone.
+func ShowsZone(format string) bool {
+	layout, err := Layout(format)
+	if err != nil {
+		return false
+	}
+	utc := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+	other := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.FixedZone("XST", 3600))
+	return utc.Format(layout) != other.Format(layout)
+}
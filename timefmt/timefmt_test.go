@@ -0,0 +1,64 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package timefmt
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMachineFormatsParse(t *testing.T) {
+	tests := []struct {
+		format string
+		layout string
+	}{
+		{FORMAT_ISO8601, time.RFC3339},
+		{FORMAT_RFC1123, time.RFC1123},
+	}
+	at := time.Date(2015, 3, 2, 10, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		for _, locale := range LOCALES {
+			t.Run(test.format+"/"+locale, func(t *testing.T) {
+				formatted, err := Format(at, test.format, locale)
+				if err != nil {
+					t.Fatal(err)
+				}
+				parsed, err := time.Parse(test.layout, formatted)
+				if err != nil {
+					t.Fatalf("Format() = %q does not parse: %v", formatted, err)
+				}
+				if !parsed.Equal(at) {
+					t.Errorf("Format() = %q parses as %v, want %v", formatted, parsed, at)
+				}
+			})
+		}
+	}
+}
+
+func TestHumanFormatsTranslated(t *testing.T) {
+	tests := []struct {
+		format string
+		locale string
+		want   string
+	}{
+		{FORMAT_LONG, "en", "Monday, 2 March 2015"},
+		{FORMAT_LONG, "fr", "lundi, 2 mars 2015"},
+		{"Mon 2 Jan", "de", "Mo 2 Mär"},
+	}
+	at := time.Date(2015, 3, 2, 10, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.format+"/"+test.locale, func(t *testing.T) {
+			formatted, err := Format(at, test.format, test.locale)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(formatted, test.want) {
+				t.Errorf("Format() = %q, want prefix %q", formatted, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package main
+
+import (
+	"encoding/json"
+	log "github.com/cihub/seelog"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	JSON_CONTENT_TYPE = "application/json"
+)
+
+// JSON representation of the time page. Name is omitted when
+// request did not carry a valid cookie.
+type timeResponse struct {
+	Local        string `json:"local"`
+	UTC          string `json:"utc"`
+	Unix         int64  `json:"unix"`
+	UnixNano     int64  `json:"unix_nano"`
+	Timezone     string `json:"timezone"`
+	Offset       int    `json:"utc_offset_seconds"`
+	Formatted    string `json:"formatted"`
+	FormattedUTC string `json:"formatted_utc"`
+	Locale       string `json:"locale"`
+	Name         string `json:"name,omitempty"`
+}
+
+// Body returned by API endpoints when request cannot be served.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Formatted fields hold the time as it would appear on the time page.
+func newTimeResponse(now time.Time, d display, name string) timeResponse {
+	_, offset := now.Zone()
+	return timeResponse{
+		Local:        now.Format(time.RFC3339),
+		UTC:          now.UTC().Format(time.RFC3339),
+		Unix:         now.Unix(),
+		UnixNano:     now.UnixNano(),
+		Timezone:     zoneName(now),
+		Offset:       offset,
+		Formatted:    d.local(now),
+		FormattedUTC: d.utc(now),
+		Locale:       d.locale,
+		Name:         name,
+	}
+}
+
+// Returns true if the client listed application/json in its Accept
+// header ahead of text/html or a wildcard. Browsers send text/html
+// first, so they continue to receive the HTML page.
+func acceptsJSON(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case JSON_CONTENT_TYPE:
+			return true
+		case "text/html", "*/*":
+			return false
+		}
+	}
+	return false
+}
+
+func handleAPITime(w http.ResponseWriter, r *http.Request) {
+	log.Info("timeserver: API time handler called.")
+	serveTime(w, r, true)
+}
+
+// Writes v to w as JSON document with status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", JSON_CONTENT_TYPE)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err)
+	}
+}
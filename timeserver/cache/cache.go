@@ -0,0 +1,175 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+//
+// Package provides a bounded least recently used cache of strings with
+// expiry, used by timeserver to avoid asking authserver for the name behind
+// a UUID on every request. Empty values record negative lookups and expire
+// sooner than others. Entries may be served for a while after they expire
+// (stale-while-revalidate) so that callers can refresh them in the
+// background, or keep using them while the source is unavailable.
+package cache
+
+import (
+	"container/list"
+	"github.com/patkaehuaea/command/clock"
+	"github.com/patkaehuaea/command/stats"
+	"sync"
+	"time"
+)
+
+// Results of Get().
+const (
+	MISS = iota
+	FRESH
+	STALE
+)
+
+type entry struct {
+	key        string
+	value      string
+	expires    time.Time
+	refreshing bool
+}
+
+// Safe for concurrent use. A size of zero disables the cache.
+type Cache struct {
+	sync.Mutex
+	size     int
+	ttl      time.Duration
+	negTTL   time.Duration
+	staleFor time.Duration
+	order    *list.List
+	entries  map[string]*list.Element
+
+	// Expires entries. Defaults to clock.Real.
+	Clock clock.Clock
+
+	Hits      *stats.Counter
+	Misses    *stats.Counter
+	StaleHits *stats.Counter
+	Evictions *stats.Counter
+}
+
+// Returns cache holding up to size entries. Values expire after ttl,
+// or negTTL if empty, and may be served stale for staleFor after
+// that.
+func New(size int, ttl time.Duration, negTTL time.Duration, staleFor time.Duration) *Cache {
+	return &Cache{
+		size:      size,
+		ttl:       ttl,
+		negTTL:    negTTL,
+		staleFor:  staleFor,
+		order:     list.New(),
+		entries:   make(map[string]*list.Element),
+		Clock:     clock.Real,
+		Hits:      stats.NewCounter(),
+		Misses:    stats.NewCounter(),
+		StaleHits: stats.NewCounter(),
+		Evictions: stats.NewCounter(),
+	}
+}
+
+// Returns value stored under key and whether it is FRESH or STALE,
+// or MISS if there is no usable value.
+func (c *Cache) Get(key string) (value string, state int) {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.Misses.Inc()
+		return "", MISS
+	}
+	e := el.Value.(*entry)
+	now := c.Clock.Now()
+	switch {
+	case now.Before(e.expires):
+		c.order.MoveToFront(el)
+		c.Hits.Inc()
+		return e.value, FRESH
+	case now.Before(e.expires.Add(c.staleFor)):
+		c.order.MoveToFront(el)
+		c.StaleHits.Inc()
+		return e.value, STALE
+	}
+	c.remove(el)
+	c.Misses.Inc()
+	return "", MISS
+}
+
+// Returns true if the caller should refresh the stale value under
+// key. Only one caller is told to refresh until Set() or Release()
+// is called for key.
+func (c *Cache) Claim(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	e := el.Value.(*entry)
+	if e.refreshing {
+		return false
+	}
+	e.refreshing = true
+	return true
+}
+
+// Gives up claim on key without changing its value, leaving it to
+// be served until it is too stale.
+func (c *Cache) Release(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*entry).refreshing = false
+	}
+}
+
+// Stores value under key, evicting least recently used entry if
+// cache is full.
+func (c *Cache) Set(key string, value string) {
+	if c.size <= 0 {
+		return
+	}
+	ttl := c.ttl
+	if value == "" {
+		ttl = c.negTTL
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	expires := c.Clock.Now().Add(ttl)
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry)
+		e.value, e.expires, e.refreshing = value, expires, false
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&entry{key: key, value: value, expires: expires})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		c.Evictions.Inc()
+	}
+}
+
+func (c *Cache) Delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Returns number of entries, including any expired but not yet
+// removed.
+func (c *Cache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.order.Len()
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*entry).key)
+}
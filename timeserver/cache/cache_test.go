@@ -0,0 +1,102 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package cache
+
+import (
+	"github.com/patkaehuaea/command/clock"
+	"testing"
+	"time"
+)
+
+// Returns cache with a one minute TTL, ten second negative TTL and
+// thirty seconds of staleness, driven by a fake clock.
+func newFakeCache(size int) (*Cache, *clock.Fake) {
+	f := clock.NewFake(time.Date(2015, 3, 8, 9, 59, 30, 0, time.UTC))
+	c := New(size, time.Minute, 10*time.Second, 30*time.Second)
+	c.Clock = f
+	return c, f
+}
+
+func TestExpiry(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		elapsed time.Duration
+		want    int
+	}{
+		{"fresh", "pat", time.Minute - time.Nanosecond, FRESH},
+		{"stale", "pat", time.Minute, STALE},
+		{"too stale", "pat", 90 * time.Second, MISS},
+		{"negative fresh", "", 10*time.Second - time.Nanosecond, FRESH},
+		{"negative stale", "", 10 * time.Second, STALE},
+		{"negative too stale", "", 40 * time.Second, MISS},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, f := newFakeCache(10)
+			c.Set("uuid", test.value)
+			f.Advance(test.elapsed)
+			value, state := c.Get("uuid")
+			if state != test.want {
+				t.Fatalf("state = %d, want %d", state, test.want)
+			}
+			if state != MISS && value != test.value {
+				t.Errorf("value = %q, want %q", value, test.value)
+			}
+			if state == MISS && c.Len() != 0 {
+				t.Errorf("Len() = %d after expiry, want 0", c.Len())
+			}
+		})
+	}
+}
+
+func TestClaim(t *testing.T) {
+	c, f := newFakeCache(10)
+	c.Set("uuid", "pat")
+	f.Advance(time.Minute)
+
+	if !c.Claim("uuid") {
+		t.Fatal("first Claim() refused")
+	}
+	if c.Claim("uuid") {
+		t.Fatal("second Claim() allowed while refreshing")
+	}
+	c.Release("uuid")
+	if !c.Claim("uuid") {
+		t.Fatal("Claim() refused after Release()")
+	}
+
+	c.Set("uuid", "kaehuaea")
+	if value, state := c.Get("uuid"); state != FRESH || value != "kaehuaea" {
+		t.Errorf("Get() = %q, %d after refresh, want %q, %d", value, state, "kaehuaea", FRESH)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	c, _ := newFakeCache(2)
+	c.Set("a", "1")
+	c.Set("b", "2")
+	c.Get("a")
+	c.Set("c", "3")
+
+	if _, state := c.Get("b"); state != MISS {
+		t.Errorf("least recently used entry kept")
+	}
+	if _, state := c.Get("a"); state != FRESH {
+		t.Errorf("recently used entry evicted")
+	}
+	if got := c.Evictions.Value(); got != 1 {
+		t.Errorf("Evictions = %d, want 1", got)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	c, _ := newFakeCache(0)
+	c.Set("uuid", "pat")
+	if _, state := c.Get("uuid"); state != MISS {
+		t.Errorf("cache of size zero stored a value")
+	}
+}
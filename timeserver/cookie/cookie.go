@@ -5,7 +5,8 @@
 //
 // Package encapsulates cookie functionality needed by personal time server.
 // Provides methods for creating a new cookie with relevant fields as well
-// as returning the value from the uuid cookie.
+// as returning the value from the uuid cookie and the UTC offset reported
+// by the browser in the tzoffset cookie.
 package cookie
 
 import (
@@ -13,6 +14,7 @@ import (
 	log "github.com/cihub/seelog"
 	"github.com/patkaehuaea/command/authserver/people"
 	"net/http"
+	"strconv"
 )
 
 const (
@@ -21,13 +23,21 @@ const (
 	MAX_AGE      = 86400
 	DELETE_AGE   = -1
 	DELETE_VALUE = "deleted"
+
+	// Set by script in head template to minutes east of UTC.
+	OFFSET_COOKIE_NAME = "tzoffset"
+	MAX_OFFSET_MINUTES = 14 * 60
 )
 
+// Set by timeserver when serving HTTPS so that browsers only send
+// the cookie back over TLS.
+var Secure = false
+
 // Returns address of new cookie with 'uuid' name, value set to value
 // path to '/' and age set accordingly. Should utilize MAX_AGE when
 // creating, and DELETE_AGE when intending to delete cookie with overwright.
 func NewCookie(value string, age int) *http.Cookie {
-	c := http.Cookie{Name: COOKIE_NAME, Value: value, Path: COOKIE_PATH, MaxAge: age}
+	c := http.Cookie{Name: COOKIE_NAME, Value: value, Path: COOKIE_PATH, MaxAge: age, Secure: Secure}
 	return &c
 }
 
@@ -47,3 +57,24 @@ func UUID(r *http.Request) (uuid string, err error) {
 	err = errors.New("cookie: value not valid uuid")
 	return
 }
+
+// Returns offset from UTC in minutes east reported by the browser.
+// Error returned if cookie not present or value out of range.
+func Offset(r *http.Request) (minutes int, err error) {
+	log.Trace("cookie: getting offset from " + OFFSET_COOKIE_NAME + " cookie.")
+
+	var cookie *http.Cookie
+	if cookie, err = r.Cookie(OFFSET_COOKIE_NAME); err != nil {
+		return
+	}
+
+	if minutes, err = strconv.Atoi(cookie.Value); err != nil {
+		return
+	}
+
+	if minutes < -MAX_OFFSET_MINUTES || minutes > MAX_OFFSET_MINUTES {
+		minutes = 0
+		err = errors.New("cookie: offset out of range")
+	}
+	return
+}
@@ -0,0 +1,98 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package main
+
+import (
+	"fmt"
+	"github.com/patkaehuaea/command/authserver/people"
+	"github.com/patkaehuaea/command/timefmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	FORMAT_PARAM = "format"
+	LOCALE_PARAM = "locale"
+)
+
+// How time is shown in response to a request. Empty format means the
+// default for locale.
+type display struct {
+	loc    *time.Location
+	format string
+	locale string
+}
+
+// Determines zone, format and locale for request. For each, a query
+// parameter overrides the user's saved preference. Without either,
+// locale is negotiated from Accept-Language and format follows locale.
+// Invalid query parameters are reported as error.
+func resolveDisplay(r *http.Request, prefs people.Prefs) (d display, err error) {
+	if d.loc, err = location(r, prefs); err != nil {
+		return
+	}
+
+	query := r.URL.Query()
+	d.format = prefs.Format
+	if format := query.Get(FORMAT_PARAM); format != "" {
+		if _, err = timefmt.Layout(format); err != nil {
+			return
+		}
+		d.format = format
+	}
+
+	d.locale = prefs.Locale
+	if locale := query.Get(LOCALE_PARAM); locale != "" {
+		if !timefmt.IsSupported(locale) {
+			err = fmt.Errorf("timeserver: Unsupported locale %q. Expected one of %s.", locale, strings.Join(timefmt.LOCALES, ", "))
+			return
+		}
+		d.locale = locale
+	}
+	if d.locale == "" {
+		d.locale = timefmt.Negotiate(r.Header.Get("Accept-Language"))
+	}
+	return
+}
+
+// Returns now in display's zone, formatted for display.
+func (d display) local(now time.Time) string {
+	return d.render(now.In(d.loc))
+}
+
+// Returns t, in its own zone, formatted for display.
+func (d display) render(t time.Time) string {
+	format := d.format
+	if format == "" {
+		format = timefmt.DefaultFormat(d.locale)
+	}
+	return d.formatOrLayout(t, format)
+}
+
+// Returns now in UTC, formatted for display and labelled UTC
+// unless format already shows the zone.
+func (d display) utc(now time.Time) string {
+	format := d.format
+	if format == "" {
+		format = timefmt.FORMAT_24H
+	}
+	formatted := d.formatOrLayout(now.UTC(), format)
+	if !timefmt.ShowsZone(format) {
+		formatted += " UTC"
+	}
+	return formatted
+}
+
+// Saved preferences are validated by authserver, but may have been
+// written by an older release. Fall back to RFC 3339 rather than fail.
+func (d display) formatOrLayout(t time.Time, format string) string {
+	formatted, err := timefmt.Format(t, format, d.locale)
+	if err != nil {
+		return t.Format(time.RFC3339)
+	}
+	return formatted
+}
@@ -0,0 +1,67 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package fault
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// Bytes written between pauses when trickling a body.
+	CHUNK_SIZE = 64
+)
+
+// Response writer that writes the body at most CHUNK_SIZE bytes at a
+// time, flushing and pausing after each chunk for as long as the chunk
+// takes to send at rate bytes per second.
+type slowWriter struct {
+	http.ResponseWriter
+	rate  int
+	sleep func(time.Duration)
+}
+
+// Returns w limited to rate bytes per second. Pauses are taken with
+// sleep so callers may supply their own clock.
+func SlowWriter(w http.ResponseWriter, rate int, sleep func(time.Duration)) http.ResponseWriter {
+	return &slowWriter{ResponseWriter: w, rate: rate, sleep: sleep}
+}
+
+func (sw *slowWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > CHUNK_SIZE {
+			chunk = chunk[:CHUNK_SIZE]
+		}
+		var written int
+		written, err = sw.ResponseWriter.Write(chunk)
+		n += written
+		if err != nil {
+			return
+		}
+		sw.Flush()
+		b = b[written:]
+		sw.sleep(time.Duration(written) * time.Second / time.Duration(sw.rate))
+	}
+	return
+}
+
+func (sw *slowWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *slowWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("fault: Response writer does not support hijacking.")
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,161 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+//
+// Package describes the latency and faults timeserver injects to simulate
+// load. A Profile samples a delay from a fixed, normal, lognormal or uniform
+// distribution, truncated to [Min, Max], and may fail a share of requests
+// with an error status, drop the connection, or trickle the response body.
+// An Injector holds named profiles and the profile assigned to each route;
+// both may be changed while the server runs through its HTTP handler.
+package fault
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	DIST_NONE      = "none"
+	DIST_FIXED     = "fixed"
+	DIST_NORMAL    = "normal"
+	DIST_LOGNORMAL = "lognormal"
+	DIST_UNIFORM   = "uniform"
+
+	DEFAULT_ERROR_STATUS = http.StatusInternalServerError
+)
+
+var (
+	ErrDistribution = errors.New("fault: Distribution must be none, fixed, normal, lognormal or uniform.")
+	ErrNegative     = errors.New("fault: Durations must not be negative.")
+	ErrBounds       = errors.New("fault: Max must not be less than min.")
+	ErrRate         = errors.New("fault: Rates must be between 0 and 1.")
+	ErrStatus       = errors.New("fault: Error status must be 500 or 503.")
+	ErrBodyRate     = errors.New("fault: Body rate must not be negative.")
+)
+
+// Duration marshalled as a string such as "250ms" so profiles can be
+// written by hand.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(data, &s); err != nil {
+		return
+	}
+	var parsed time.Duration
+	if parsed, err = time.ParseDuration(s); err != nil {
+		return
+	}
+	*d = Duration(parsed)
+	return
+}
+
+// Latency and faults applied to each request on a route. Mean and
+// Deviation describe the sampled delay; for uniform the delay lies
+// within Deviation of Mean. Samples are clamped to Min and, when
+// non-zero, Max. ErrorRate and DropRate are probabilities between 0
+// and 1. BodyRate, when non-zero, limits the response body to that
+// many bytes per second.
+type Profile struct {
+	Distribution string   `json:"distribution,omitempty"`
+	Mean         Duration `json:"mean,omitempty"`
+	Deviation    Duration `json:"deviation,omitempty"`
+	Min          Duration `json:"min,omitempty"`
+	Max          Duration `json:"max,omitempty"`
+	ErrorRate    float64  `json:"error_rate,omitempty"`
+	ErrorStatus  int      `json:"error_status,omitempty"`
+	DropRate     float64  `json:"drop_rate,omitempty"`
+	BodyRate     int      `json:"body_bytes_per_sec,omitempty"`
+}
+
+// What should happen to a single request. Status is zero unless the
+// request should fail.
+type Outcome struct {
+	Delay    time.Duration
+	Drop     bool
+	Status   int
+	BodyRate int
+}
+
+func (p Profile) Validate() error {
+	switch p.Distribution {
+	case "", DIST_NONE, DIST_FIXED, DIST_NORMAL, DIST_LOGNORMAL, DIST_UNIFORM:
+	default:
+		return ErrDistribution
+	}
+	if p.Mean < 0 || p.Deviation < 0 || p.Min < 0 || p.Max < 0 {
+		return ErrNegative
+	}
+	if p.Max != 0 && p.Max < p.Min {
+		return ErrBounds
+	}
+	if p.ErrorRate < 0 || p.ErrorRate > 1 || p.DropRate < 0 || p.DropRate > 1 {
+		return ErrRate
+	}
+	switch p.ErrorStatus {
+	case 0, http.StatusInternalServerError, http.StatusServiceUnavailable:
+	default:
+		return ErrStatus
+	}
+	if p.BodyRate < 0 {
+		return ErrBodyRate
+	}
+	return nil
+}
+
+// Returns delay drawn from the profile's distribution, truncated
+// to its bounds. Never negative.
+func (p Profile) Delay() (d time.Duration) {
+	mean, dev := float64(p.Mean), float64(p.Deviation)
+	switch p.Distribution {
+	case DIST_FIXED:
+		d = time.Duration(mean)
+	case DIST_NORMAL:
+		d = time.Duration(rand.NormFloat64()*dev + mean)
+	case DIST_LOGNORMAL:
+		// Parameters chosen so the samples, rather than their
+		// logarithms, have the requested mean and deviation.
+		if mean > 0 {
+			sigma2 := math.Log(1 + (dev*dev)/(mean*mean))
+			mu := math.Log(mean) - sigma2/2
+			d = time.Duration(math.Exp(mu + math.Sqrt(sigma2)*rand.NormFloat64()))
+		}
+	case DIST_UNIFORM:
+		d = time.Duration(mean - dev + rand.Float64()*2*dev)
+	}
+	if d < time.Duration(p.Min) {
+		d = time.Duration(p.Min)
+	}
+	if p.Max != 0 && d > time.Duration(p.Max) {
+		d = time.Duration(p.Max)
+	}
+	return
+}
+
+// Decides what happens to one request. A dropped request is never
+// also failed with a status.
+func (p Profile) Sample() (o Outcome) {
+	o.Delay = p.Delay()
+	o.BodyRate = p.BodyRate
+	if p.DropRate > 0 && rand.Float64() < p.DropRate {
+		o.Drop = true
+		return
+	}
+	if p.ErrorRate > 0 && rand.Float64() < p.ErrorRate {
+		o.Status = p.ErrorStatus
+		if o.Status == 0 {
+			o.Status = DEFAULT_ERROR_STATUS
+		}
+	}
+	return
+}
@@ -0,0 +1,151 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package fault
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/cihub/seelog"
+	"net/http"
+	"os"
+	"sync"
+)
+
+const (
+	// Built in profiles. Routes without an assignment use NONE.
+	DEFAULT = "default"
+	NONE    = "none"
+
+	// Limits size of configuration accepted by ServeHTTP().
+	MAX_CONFIG_BYTES = 1 << 16
+)
+
+var (
+	ErrUnknownProfile = errors.New("fault: Unknown profile.")
+	ErrBuiltIn        = errors.New("fault: The none profile can't be changed.")
+)
+
+// Profiles by name and the profile name assigned to each route.
+type Config struct {
+	Profiles map[string]Profile `json:"profiles,omitempty"`
+	Routes   map[string]string  `json:"routes,omitempty"`
+}
+
+// Holds profiles and route assignments. Safe for concurrent use.
+type Injector struct {
+	sync.RWMutex
+	profiles map[string]Profile
+	routes   map[string]string
+}
+
+// Returns injector with def registered as DEFAULT alongside the
+// empty NONE profile, and no routes assigned.
+func NewInjector(def Profile) *Injector {
+	return &Injector{
+		profiles: map[string]Profile{DEFAULT: def, NONE: Profile{}},
+		routes:   make(map[string]string),
+	}
+}
+
+// Returns name and profile assigned to route.
+func (in *Injector) Profile(route string) (name string, p Profile) {
+	in.RLock()
+	defer in.RUnlock()
+	name, ok := in.routes[route]
+	if !ok {
+		name = NONE
+	}
+	return name, in.profiles[name]
+}
+
+// Returns copy of every profile and route assignment.
+func (in *Injector) Config() (c Config) {
+	in.RLock()
+	defer in.RUnlock()
+	c = Config{Profiles: make(map[string]Profile), Routes: make(map[string]string)}
+	for name, p := range in.profiles {
+		c.Profiles[name] = p
+	}
+	for route, name := range in.routes {
+		c.Routes[route] = name
+	}
+	return
+}
+
+// Adds or replaces the profiles in c then assigns its routes. An
+// empty profile name in Routes reverts the route to NONE. Nothing
+// changes unless all of c is valid.
+func (in *Injector) Apply(c Config) (err error) {
+	in.Lock()
+	defer in.Unlock()
+	for name, p := range c.Profiles {
+		if name == NONE {
+			return ErrBuiltIn
+		}
+		if err = p.Validate(); err != nil {
+			return
+		}
+	}
+	for _, name := range c.Routes {
+		if _, ok := c.Profiles[name]; ok || name == "" {
+			continue
+		}
+		if _, ok := in.profiles[name]; !ok {
+			return ErrUnknownProfile
+		}
+	}
+
+	for name, p := range c.Profiles {
+		in.profiles[name] = p
+	}
+	for route, name := range c.Routes {
+		if name == "" {
+			delete(in.routes, route)
+			continue
+		}
+		in.routes[route] = name
+	}
+	return
+}
+
+// Applies configuration read from JSON file.
+func (in *Injector) Load(file string) (err error) {
+	var data []byte
+	if data, err = os.ReadFile(file); err != nil {
+		return
+	}
+	var c Config
+	if err = json.Unmarshal(data, &c); err != nil {
+		return
+	}
+	return in.Apply(c)
+}
+
+// Writes current configuration as JSON. POST applies the Config in
+// the request body first, so profiles can be switched at runtime.
+func (in *Injector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if r.Method == "POST" {
+		var c Config
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_CONFIG_BYTES)).Decode(&c)
+		if err == nil {
+			err = in.Apply(c)
+		}
+		if err != nil {
+			log.Warn(err)
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		log.Info("fault: Configuration updated.")
+	}
+
+	if err := json.NewEncoder(w).Encode(in.Config()); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,87 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/patkaehuaea/command/authserver/client"
+	"github.com/patkaehuaea/command/config"
+	"github.com/patkaehuaea/command/timeserver/fault"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Request headers honoured when --simulate-headers is set, letting an
+// integration test force behaviour for a single request.
+const (
+	// Duration such as 250ms replacing the delay sampled from the
+	// route's fault profile.
+	SIMULATE_DELAY_HEADER = "X-Simulate-Delay"
+
+	// Status code the request fails with. 200 suppresses any error
+	// or drop the route's fault profile would have injected.
+	SIMULATE_STATUS_HEADER = "X-Simulate-Status"
+
+	// Makes user lookup fail as though authserver were unavailable,
+	// or with "unknown" as though the user didn't exist.
+	SIMULATE_AUTH_HEADER  = "X-Simulate-Auth-Failure"
+	SIMULATE_AUTH_UNKNOWN = "unknown"
+)
+
+var (
+	errSimulatedDelay   = errors.New("timeserver: X-Simulate-Delay must be a non-negative duration such as 250ms.")
+	errSimulatedStatus  = errors.New("timeserver: X-Simulate-Status must be a status code between 200 and 599.")
+	errSimulatedAuth    = fmt.Errorf("%w: simulated failure", client.ErrUnavailable)
+	errSimulatedUnknown = errors.New("timeserver: Simulated empty result from get user.")
+)
+
+// Returns o with any delay and status given by the request's headers
+// in place of those sampled from the fault profile. Returns o
+// unchanged unless --simulate-headers is set.
+func simulateOutcome(r *http.Request, o fault.Outcome) (fault.Outcome, error) {
+	if !*config.SimHeaders {
+		return o, nil
+	}
+
+	if v := r.Header.Get(SIMULATE_DELAY_HEADER); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return o, errSimulatedDelay
+		}
+		o.Delay = d
+	}
+
+	if v := r.Header.Get(SIMULATE_STATUS_HEADER); v != "" {
+		status, err := strconv.Atoi(v)
+		if err != nil || status < http.StatusOK || status > 599 {
+			return o, errSimulatedStatus
+		}
+		o.Drop = false
+		o.Status = 0
+		if status != http.StatusOK {
+			o.Status = status
+		}
+	}
+	return o, nil
+}
+
+// Returns error getUUIDThenName() should fail with, or nil to look
+// the user up as usual.
+func simulatedAuthFailure(r *http.Request) error {
+	if !*config.SimHeaders {
+		return nil
+	}
+	switch r.Header.Get(SIMULATE_AUTH_HEADER) {
+	case "":
+		return nil
+	case SIMULATE_AUTH_UNKNOWN:
+		return errSimulatedUnknown
+	default:
+		return errSimulatedAuth
+	}
+}
@@ -0,0 +1,93 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package sntp
+
+import (
+	"github.com/patkaehuaea/command/clock"
+	"sync"
+	"time"
+)
+
+const (
+	// Buckets idle for this long are full again and can be dropped.
+	SWEEP_INTERVAL = time.Minute
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Token bucket rate limiter keyed by client address. Each client
+// earns rate tokens per second up to burst, and spends one per request.
+type Limiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	done    chan struct{}
+	once    sync.Once
+
+	// Refills buckets and paces sweep(). Defaults to clock.Real.
+	Clock clock.Clock
+}
+
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket), done: make(chan struct{}), Clock: clock.Real}
+}
+
+// Returns true if client may be served now. A rate of zero or less
+// disables limiting.
+func (l *Limiter) Allow(client string) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	now := l.Clock.Now()
+
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Periodically drops buckets that have refilled so memory is bounded
+// by the number of recently active clients. Runs until stop().
+func (l *Limiter) sweep() {
+	ticker := l.Clock.NewTicker(SWEEP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case now := <-ticker.C():
+			l.Lock()
+			for client, b := range l.buckets {
+				if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+					delete(l.buckets, client)
+				}
+			}
+			l.Unlock()
+		}
+	}
+}
+
+func (l *Limiter) stop() {
+	l.once.Do(func() { close(l.done) })
+}
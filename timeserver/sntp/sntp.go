@@ -0,0 +1,214 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+//
+// Package implements a Simple Network Time Protocol version 4 server as
+// described by RFC 4330. Responses are sourced from the local clock, which
+// is advertised as an uncalibrated local clock ("LOCL") at the configured
+// stratum. Each client address is rate limited; clients over their limit
+// receive a RATE kiss-o'-death packet, which is the same size as the request
+// so the server can't be used to amplify traffic.
+package sntp
+
+import (
+	"encoding/binary"
+	"errors"
+	log "github.com/cihub/seelog"
+	"github.com/patkaehuaea/command/clock"
+	"github.com/patkaehuaea/command/stats"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	PACKET_SIZE = 48
+
+	// Seconds between the NTP epoch, 1900, and the Unix epoch.
+	NTP_EPOCH_OFFSET = 2208988800
+
+	MODE_CLIENT = 3
+	MODE_SERVER = 4
+
+	LEAP_NONE = 0
+	// Signals the server's clock is not synchronized.
+	LEAP_ALARM = 3
+
+	MIN_VERSION = 1
+	MAX_VERSION = 4
+
+	// Log2 seconds; roughly one microsecond.
+	PRECISION = -20
+
+	KISS_STRATUM = 0
+	MAX_STRATUM  = 15
+
+	RESULT_SERVED  = "served"
+	RESULT_LIMITED = "limited"
+	RESULT_INVALID = "invalid"
+)
+
+var (
+	LOCAL_CLOCK_ID = [4]byte{'L', 'O', 'C', 'L'}
+	RATE_KISS_CODE = [4]byte{'R', 'A', 'T', 'E'}
+
+	ErrShortPacket = errors.New("sntp: Packet shorter than 48 bytes.")
+	ErrNotClient   = errors.New("sntp: Packet mode is not client.")
+	ErrBadVersion  = errors.New("sntp: Unsupported version.")
+)
+
+// Serves SNTP requests received on a packet connection.
+type Server struct {
+	sync.Mutex
+	stratum   uint8
+	reference time.Time
+	limiter   *Limiter
+	conn      net.PacketConn
+
+	// Supplies the time placed in responses. Defaults to clock.Real.
+	Clock clock.Clock
+
+	// Requests counted by result: served, limited or invalid.
+	Requests *stats.CounterVec
+}
+
+// Returns server advertising stratum and allowing each client rate
+// requests per second with bursts of up to burst requests.
+func NewServer(stratum int, rate float64, burst int) (s *Server, err error) {
+	if stratum < 1 || stratum > MAX_STRATUM {
+		err = errors.New("sntp: Stratum must be between 1 and 15.")
+		return
+	}
+	s = &Server{
+		stratum:  uint8(stratum),
+		limiter:  NewLimiter(rate, burst),
+		Clock:    clock.Real,
+		Requests: stats.NewCounterVec("result"),
+	}
+	return
+}
+
+// Listens on UDP address and serves requests until Close() is called.
+func (s *Server) ListenAndServe(addr string) (err error) {
+	var conn net.PacketConn
+	if conn, err = net.ListenPacket("udp", addr); err != nil {
+		return
+	}
+	return s.Serve(conn)
+}
+
+// Serves requests arriving on conn until conn is closed. Requests are
+// answered in turn; building a response takes a few microseconds so a
+// single goroutine keeps receive timestamps accurate.
+func (s *Server) Serve(conn net.PacketConn) (err error) {
+	s.Lock()
+	s.conn = conn
+	s.Unlock()
+	s.reference = s.Clock.Now()
+	go s.limiter.sweep()
+
+	buf := make([]byte, 512)
+	for {
+		var n int
+		var addr net.Addr
+		if n, addr, err = conn.ReadFrom(buf); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				err = nil
+			}
+			return
+		}
+		receive := s.Clock.Now()
+
+		var resp []byte
+		if resp, err = s.respond(buf[:n], addr, receive); err != nil {
+			log.Debug(err)
+			s.Requests.With(RESULT_INVALID).Inc()
+			err = nil
+			continue
+		}
+		if _, err = conn.WriteTo(resp, addr); err != nil {
+			log.Warn(err)
+			err = nil
+		}
+	}
+}
+
+// Stops serving and releases the port.
+func (s *Server) Close() error {
+	s.limiter.stop()
+	s.Lock()
+	defer s.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// Builds response to req received from addr at receive. Returns
+// error if req is not a valid client request.
+func (s *Server) respond(req []byte, addr net.Addr, receive time.Time) (resp []byte, err error) {
+	if len(req) < PACKET_SIZE {
+		return nil, ErrShortPacket
+	}
+	version := (req[0] >> 3) & 0x07
+	mode := req[0] & 0x07
+	if mode != MODE_CLIENT {
+		return nil, ErrNotClient
+	}
+	if version < MIN_VERSION || version > MAX_VERSION {
+		return nil, ErrBadVersion
+	}
+
+	resp = make([]byte, PACKET_SIZE)
+	resp[0] = LEAP_NONE<<6 | version<<3 | MODE_SERVER
+	resp[2] = req[2] // Poll interval is copied from request.
+	precision := int8(PRECISION)
+	resp[3] = byte(precision)
+	// Originate timestamp is the client's transmit timestamp.
+	copy(resp[24:32], req[40:48])
+
+	if !s.limiter.Allow(host(addr)) {
+		s.Requests.With(RESULT_LIMITED).Inc()
+		resp[0] = LEAP_ALARM<<6 | version<<3 | MODE_SERVER
+		resp[1] = KISS_STRATUM
+		copy(resp[12:16], RATE_KISS_CODE[:])
+		return
+	}
+
+	resp[1] = s.stratum
+	// Root delay and root dispersion are zero for a local clock.
+	copy(resp[12:16], LOCAL_CLOCK_ID[:])
+	putTimestamp(resp[16:24], s.reference)
+	putTimestamp(resp[32:40], receive)
+	putTimestamp(resp[40:48], s.Clock.Now())
+	s.Requests.With(RESULT_SERVED).Inc()
+	return
+}
+
+// Writes t as 64 bit NTP timestamp: 32 bits of seconds since 1900
+// followed by 32 bits of fraction.
+func putTimestamp(b []byte, t time.Time) {
+	seconds := uint64(t.Unix() + NTP_EPOCH_OFFSET)
+	fraction := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	binary.BigEndian.PutUint64(b, seconds<<32|fraction)
+}
+
+// Reads 64 bit NTP timestamp. Exported for use by clients.
+func Timestamp(b []byte) time.Time {
+	v := binary.BigEndian.Uint64(b)
+	seconds := int64(v>>32) - NTP_EPOCH_OFFSET
+	nanos := int64(((v & 0xffffffff) * uint64(time.Second)) >> 32)
+	return time.Unix(seconds, nanos)
+}
+
+func host(addr net.Addr) string {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return udp.IP.String()
+	}
+	h, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return h
+}
@@ -0,0 +1,175 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package sntp
+
+import (
+	"bytes"
+	"github.com/patkaehuaea/command/clock"
+	"net"
+	"testing"
+	"time"
+)
+
+// Starts server on a local UDP port and returns a client connected
+// to it.
+func serve(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(conn)
+	t.Cleanup(func() { s.Close() })
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// Sends a version 4 client request carrying transmit and returns
+// the response.
+func query(t *testing.T, client net.Conn, transmit time.Time) []byte {
+	t.Helper()
+	req := make([]byte, PACKET_SIZE)
+	req[0] = 4<<3 | MODE_CLIENT
+	putTimestamp(req[40:48], transmit)
+	if _, err := client.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp := make([]byte, 512)
+	n, err := client.Read(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != PACKET_SIZE {
+		t.Fatalf("response is %d bytes, want %d", n, PACKET_SIZE)
+	}
+	return resp[:n]
+}
+
+func TestServe(t *testing.T) {
+	s, err := NewServer(2, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := serve(t, s)
+
+	transmit := time.Date(2015, 3, 8, 9, 59, 30, 0, time.UTC)
+	resp := query(t, client, transmit)
+
+	if mode := resp[0] & 0x07; mode != MODE_SERVER {
+		t.Errorf("mode = %d, want %d", mode, MODE_SERVER)
+	}
+	if leap := resp[0] >> 6; leap != LEAP_NONE {
+		t.Errorf("leap = %d, want %d", leap, LEAP_NONE)
+	}
+	if resp[1] != 2 {
+		t.Errorf("stratum = %d, want 2", resp[1])
+	}
+	if !bytes.Equal(resp[12:16], LOCAL_CLOCK_ID[:]) {
+		t.Errorf("reference id = %q, want %q", resp[12:16], LOCAL_CLOCK_ID[:])
+	}
+	if originate := Timestamp(resp[24:32]); !originate.Equal(transmit) {
+		t.Errorf("originate = %v, want client transmit %v", originate, transmit)
+	}
+	receive, sent := Timestamp(resp[32:40]), Timestamp(resp[40:48])
+	if receive.After(sent) {
+		t.Errorf("receive %v after transmit %v", receive, sent)
+	}
+	if skew := time.Since(sent); skew < 0 || skew > time.Second {
+		t.Errorf("transmit %v is %v from now", sent, skew)
+	}
+}
+
+func TestServeFixedTime(t *testing.T) {
+	at := time.Date(2015, 3, 8, 9, 59, 30, 500000000, time.UTC)
+	s, err := NewServer(1, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Clock = clock.Fixed(clock.Real, at)
+	client := serve(t, s)
+
+	resp := query(t, client, time.Now())
+	for _, field := range []struct {
+		name  string
+		start int
+	}{{"reference", 16}, {"receive", 32}, {"transmit", 40}} {
+		if got := Timestamp(resp[field.start : field.start+8]); got.Sub(at).Abs() > time.Microsecond {
+			t.Errorf("%s = %v, want %v", field.name, got, at)
+		}
+	}
+}
+
+func TestServeRateLimits(t *testing.T) {
+	const burst = 2
+	s, err := NewServer(2, 0.001, burst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := serve(t, s)
+
+	for i := 0; i < burst; i++ {
+		if resp := query(t, client, time.Now()); resp[1] != 2 {
+			t.Fatalf("request %d stratum = %d, want 2", i+1, resp[1])
+		}
+	}
+
+	transmit := time.Now()
+	resp := query(t, client, transmit)
+	if mode := resp[0] & 0x07; mode != MODE_SERVER {
+		t.Errorf("mode = %d, want %d", mode, MODE_SERVER)
+	}
+	if leap := resp[0] >> 6; leap != LEAP_ALARM {
+		t.Errorf("leap = %d, want %d", leap, LEAP_ALARM)
+	}
+	if resp[1] != KISS_STRATUM {
+		t.Errorf("stratum = %d, want kiss-o'-death %d", resp[1], KISS_STRATUM)
+	}
+	if !bytes.Equal(resp[12:16], RATE_KISS_CODE[:]) {
+		t.Errorf("kiss code = %q, want %q", resp[12:16], RATE_KISS_CODE[:])
+	}
+	if originate := Timestamp(resp[24:32]); originate.Sub(transmit).Abs() > time.Microsecond {
+		t.Errorf("originate = %v, want client transmit %v", originate, transmit)
+	}
+	if got := s.Requests.With(RESULT_LIMITED).Value(); got != 1 {
+		t.Errorf("limited requests = %d, want 1", got)
+	}
+}
+
+func TestLimiterRefills(t *testing.T) {
+	f := clock.NewFake(time.Date(2015, 3, 8, 9, 59, 30, 0, time.UTC))
+	l := NewLimiter(1, 2)
+	l.Clock = f
+
+	tests := []struct {
+		advance time.Duration
+		client  string
+		want    bool
+	}{
+		{0, "10.0.0.1", true},
+		{0, "10.0.0.1", true},
+		{0, "10.0.0.1", false},
+		{0, "10.0.0.2", true},
+		{500 * time.Millisecond, "10.0.0.1", false},
+		{500 * time.Millisecond, "10.0.0.1", true},
+		{0, "10.0.0.1", false},
+		{time.Hour, "10.0.0.1", true},
+		{0, "10.0.0.1", true},
+		{0, "10.0.0.1", false},
+	}
+	for i, test := range tests {
+		f.Advance(test.advance)
+		if got := l.Allow(test.client); got != test.want {
+			t.Errorf("request %d from %s after %v: Allow() = %v, want %v", i+1, test.client, test.advance, got, test.want)
+		}
+	}
+}
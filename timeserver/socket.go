@@ -0,0 +1,255 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package main
+
+import (
+	log "github.com/cihub/seelog"
+	"github.com/gorilla/websocket"
+	"github.com/patkaehuaea/command/authserver/people"
+	"github.com/patkaehuaea/command/config"
+	"net/http"
+	"time"
+)
+
+const (
+	SOCKET_MAX_MESSAGE  = 4096
+	SOCKET_MIN_INTERVAL = 100 * time.Millisecond
+	SOCKET_WRITE_WAIT   = 10 * time.Second
+
+	// Message types sent by client.
+	MSG_SUBSCRIBE = "subscribe"
+	MSG_INTERVAL  = "interval"
+	MSG_PAUSE     = "pause"
+	MSG_RESUME    = "resume"
+
+	// Message types sent by server.
+	MSG_HELLO = "hello"
+	MSG_STATE = "state"
+	MSG_TICK  = "tick"
+	MSG_ERROR = "error"
+)
+
+// Default origin check rejects cross-site pages, which keeps other
+// sites from opening sockets with a visitor's uuid cookie.
+var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+// Control message sent by client, e.g.
+// {"type":"subscribe","zones":["Asia/Tokyo","Europe/Paris"]} or
+// {"type":"interval","interval":"5s"}.
+type socketRequest struct {
+	Type     string   `json:"type"`
+	Zones    []string `json:"zones,omitempty"`
+	Interval string   `json:"interval,omitempty"`
+}
+
+// Message sent to client. Hello and state messages describe the
+// subscription; ticks carry the time in each subscribed zone.
+type socketMessage struct {
+	Type     string       `json:"type"`
+	Name     string       `json:"name,omitempty"`
+	Zones    []string     `json:"zones,omitempty"`
+	Interval string       `json:"interval,omitempty"`
+	Paused   bool         `json:"paused"`
+	UTC      string       `json:"utc,omitempty"`
+	Times    []clockEntry `json:"times,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// State of one connection. Only the goroutine running
+// handleTimeSocket touches it.
+type subscription struct {
+	conn     *websocket.Conn
+	display  display
+	name     string
+	zones    []string
+	locs     []*time.Location
+	interval time.Duration
+	paused   bool
+}
+
+func (s *subscription) write(m socketMessage) error {
+	s.conn.SetWriteDeadline(time.Now().Add(SOCKET_WRITE_WAIT))
+	return s.conn.WriteJSON(m)
+}
+
+func (s *subscription) state(messageType string) socketMessage {
+	return socketMessage{Type: messageType, Name: s.name, Zones: s.zones, Interval: s.interval.String(), Paused: s.paused}
+}
+
+// Subscribes to zones, loading each once so ticks need not. Leaves
+// the subscription unchanged if any zone is unknown.
+func (s *subscription) subscribe(zones []string) (err error) {
+	locs := make([]*time.Location, len(zones))
+	for i, zone := range zones {
+		if zone == "" {
+			return zoneError{name: zone}
+		}
+		if locs[i], err = loadLocation(zone); err != nil {
+			return
+		}
+	}
+	s.zones, s.locs = zones, locs
+	return
+}
+
+// Returns time in each subscribed zone, or in the zone resolved for
+// the request when no zones have been subscribed.
+func (s *subscription) tick(now time.Time) socketMessage {
+	m := socketMessage{Type: MSG_TICK, UTC: now.UTC().Format(time.RFC3339Nano), Paused: s.paused}
+	if len(s.zones) == 0 {
+		local := now.In(s.display.loc)
+		m.Times = []clockEntry{clockEntryAt(local, s.display, zoneName(local))}
+		return m
+	}
+	for i, zone := range s.zones {
+		m.Times = append(m.Times, clockEntryAt(now.In(s.locs[i]), s.display, zone))
+	}
+	return m
+}
+
+// Applies control message. Returns message to send in reply, and
+// true if the interval changed and the ticker must be reset.
+func (s *subscription) apply(req socketRequest) (reply socketMessage, reset bool) {
+	switch req.Type {
+	case MSG_SUBSCRIBE:
+		if err := s.subscribe(req.Zones); err != nil {
+			return socketMessage{Type: MSG_ERROR, Error: "timeserver: Subscription contains unknown time zone."}, false
+		}
+	case MSG_INTERVAL:
+		interval, err := time.ParseDuration(req.Interval)
+		if err != nil || interval < SOCKET_MIN_INTERVAL {
+			return socketMessage{Type: MSG_ERROR, Error: "timeserver: Interval must be a duration of at least " + SOCKET_MIN_INTERVAL.String() + "."}, false
+		}
+		s.interval = interval
+		reset = true
+	case MSG_PAUSE:
+		s.paused = true
+	case MSG_RESUME:
+		s.paused = false
+	default:
+		return socketMessage{Type: MSG_ERROR, Error: "timeserver: Unknown message type " + req.Type + "."}, false
+	}
+	reply = s.state(MSG_STATE)
+	return
+}
+
+// Reads control messages into requests until the connection fails,
+// the client stops answering pings, or done is closed. Closes requests
+// on return.
+func readSocket(conn *websocket.Conn, requests chan<- socketRequest, done <-chan struct{}) {
+	defer close(requests)
+
+	deadline := func() time.Time { return time.Now().Add(2 * *config.StreamBeat) }
+	conn.SetReadLimit(SOCKET_MAX_MESSAGE)
+	conn.SetReadDeadline(deadline())
+	conn.SetPongHandler(func(string) error { return conn.SetReadDeadline(deadline()) })
+
+	for {
+		var req socketRequest
+		if err := conn.ReadJSON(&req); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Debug(err)
+			}
+			return
+		}
+		select {
+		case requests <- req:
+		case <-done:
+			return
+		}
+	}
+}
+
+// Upgrades request to WebSocket and sends the time every interval.
+// Identity is taken from the uuid cookie, and the default zone,
+// format and locale are resolved as for /time. Clients control the
+// subscription with socketRequest messages. Connection is closed with
+// a going away status when the server shuts down.
+func handleTimeSocket(w http.ResponseWriter, r *http.Request) {
+	log.Info("timeserver: Time socket handler called.")
+
+	name, _ := getUUIDThenName(r)
+	var prefs people.Prefs
+	if name != "" {
+		prefs = getPrefs(r)
+	}
+
+	d, err := resolveDisplay(r, prefs)
+	if err != nil {
+		log.Warn(err)
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	// Hijacked connections aren't tracked by http.Server.Shutdown().
+	if !trackSocket() {
+		writeJSON(w, http.StatusServiceUnavailable, errorResponse{Error: "timeserver: Server is shutting down."})
+		return
+	}
+	defer openSockets.Done()
+
+	// Upgrade replies to the client itself on failure.
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+	defer conn.Close()
+
+	s := &subscription{conn: conn, display: d, name: name, interval: *config.StreamInt}
+	if err := s.subscribe(prefs.Zones); err != nil {
+		log.Warn(err)
+	}
+	requests := make(chan socketRequest)
+	done := make(chan struct{})
+	defer close(done)
+	go readSocket(conn, requests, done)
+
+	ticker := config.Clock.NewTicker(s.interval)
+	defer ticker.Stop()
+	ping := time.NewTicker(*config.StreamBeat)
+	defer ping.Stop()
+
+	if err := s.write(s.state(MSG_HELLO)); err != nil {
+		log.Warn(err)
+		return
+	}
+
+	for {
+		select {
+		case <-shuttingDown:
+			closing := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+			conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(SOCKET_WRITE_WAIT))
+			return
+		case req, ok := <-requests:
+			if !ok {
+				log.Debug("timeserver: Time socket client disconnected.")
+				return
+			}
+			reply, reset := s.apply(req)
+			if reset {
+				ticker.Reset(s.interval)
+			}
+			if err := s.write(reply); err != nil {
+				log.Warn(err)
+				return
+			}
+		case <-ticker.C():
+			if s.paused {
+				continue
+			}
+			if err := s.write(s.tick(config.Clock.Now())); err != nil {
+				log.Warn(err)
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(SOCKET_WRITE_WAIT)); err != nil {
+				log.Warn(err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/patkaehuaea/command/clock"
+	"github.com/patkaehuaea/command/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Dials handleTimeSocket served with config.Clock set to f and reads
+// the hello message.
+func dialTimeSocket(t *testing.T, f *clock.Fake) *websocket.Conn {
+	t.Helper()
+	saved := config.Clock
+	config.Clock = f
+	t.Cleanup(func() { config.Clock = saved })
+
+	srv := httptest.NewServer(http.HandlerFunc(handleTimeSocket))
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	hello := readSocketMessage(t, conn)
+	if hello.Type != MSG_HELLO || hello.Interval != config.StreamInt.String() || hello.Paused {
+		t.Fatalf("hello = %+v", hello)
+	}
+	return conn
+}
+
+func readSocketMessage(t *testing.T, conn *websocket.Conn) (m socketMessage) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&m); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// Sends req and returns the reply.
+func sendSocketRequest(t *testing.T, conn *websocket.Conn, req socketRequest) socketMessage {
+	t.Helper()
+	if err := conn.WriteJSON(req); err != nil {
+		t.Fatal(err)
+	}
+	return readSocketMessage(t, conn)
+}
+
+func TestSocketRejectsBadRequests(t *testing.T) {
+	tests := []struct {
+		name string
+		req  socketRequest
+		want string
+	}{
+		{"interval below minimum", socketRequest{Type: MSG_INTERVAL, Interval: "50ms"}, SOCKET_MIN_INTERVAL.String()},
+		{"interval not a duration", socketRequest{Type: MSG_INTERVAL, Interval: "often"}, SOCKET_MIN_INTERVAL.String()},
+		{"unknown zone", socketRequest{Type: MSG_SUBSCRIBE, Zones: []string{"Asia/Tokyo", "Mars/Olympus_Mons"}}, "unknown time zone"},
+		{"empty zone", socketRequest{Type: MSG_SUBSCRIBE, Zones: []string{""}}, "unknown time zone"},
+		{"unknown type", socketRequest{Type: "rewind"}, "Unknown message type rewind"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := dialTimeSocket(t, clock.NewFake(time.Date(2015, 3, 8, 9, 59, 30, 0, time.UTC)))
+			reply := sendSocketRequest(t, conn, test.req)
+			if reply.Type != MSG_ERROR || !strings.Contains(reply.Error, test.want) {
+				t.Errorf("reply = %+v, want error containing %q", reply, test.want)
+			}
+
+			// Subscription is unchanged.
+			state := sendSocketRequest(t, conn, socketRequest{Type: MSG_RESUME})
+			if state.Type != MSG_STATE || len(state.Zones) != 0 || state.Interval != config.StreamInt.String() {
+				t.Errorf("state after rejected request = %+v", state)
+			}
+		})
+	}
+}
+
+func TestSocketTicks(t *testing.T) {
+	start := time.Date(2015, 3, 8, 9, 59, 30, 0, time.UTC)
+	f := clock.NewFake(start)
+	conn := dialTimeSocket(t, f)
+	zones := []string{"Asia/Tokyo", "Europe/Paris"}
+
+	state := sendSocketRequest(t, conn, socketRequest{Type: MSG_SUBSCRIBE, Zones: zones})
+	if state.Type != MSG_STATE || strings.Join(state.Zones, ",") != strings.Join(zones, ",") {
+		t.Fatalf("subscribe reply = %+v", state)
+	}
+	state = sendSocketRequest(t, conn, socketRequest{Type: MSG_INTERVAL, Interval: "5s"})
+	if state.Type != MSG_STATE || state.Interval != "5s" {
+		t.Fatalf("interval reply = %+v", state)
+	}
+
+	f.Advance(5 * time.Second)
+	now := start.Add(5 * time.Second)
+	tick := readSocketMessage(t, conn)
+	if tick.Type != MSG_TICK || tick.UTC != now.Format(time.RFC3339Nano) {
+		t.Fatalf("tick = %+v, want utc %s", tick, now.Format(time.RFC3339Nano))
+	}
+	if len(tick.Times) != len(zones) {
+		t.Fatalf("tick has %d times, want %d", len(tick.Times), len(zones))
+	}
+	for i, zone := range zones {
+		loc, _ := time.LoadLocation(zone)
+		if want := now.In(loc).Format(time.RFC3339); tick.Times[i].Zone != zone || tick.Times[i].Time != want {
+			t.Errorf("times[%d] = %s %s, want %s %s", i, tick.Times[i].Zone, tick.Times[i].Time, zone, want)
+		}
+	}
+
+	// No tick may be sent between the replies while paused.
+	if state = sendSocketRequest(t, conn, socketRequest{Type: MSG_PAUSE}); state.Type != MSG_STATE || !state.Paused {
+		t.Fatalf("pause reply = %+v", state)
+	}
+	f.Advance(5 * time.Second)
+	if state = sendSocketRequest(t, conn, socketRequest{Type: MSG_RESUME}); state.Type != MSG_STATE || state.Paused {
+		t.Fatalf("resume reply = %+v", state)
+	}
+}
@@ -0,0 +1,110 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"github.com/patkaehuaea/command/authserver/people"
+	"github.com/patkaehuaea/command/config"
+	"net/http"
+	"time"
+)
+
+const (
+	EVENT_STREAM_CONTENT_TYPE = "text/event-stream"
+	TIME_EVENT                = "time"
+)
+
+// Pushes the time to the client as Server-Sent Events every
+// --stream-interval until the client disconnects. Identity, zone,
+// format and locale are resolved once when the client subscribes,
+// accepting the same query parameters as /time. A comment line is
+// written as heartbeat whenever nothing else has been sent for
+// --stream-heartbeat so that proxies don't close an idle connection.
+// Stream ends when the server begins shutting down.
+func handleTimeStream(w http.ResponseWriter, r *http.Request) {
+	log.Info("timeserver: Time stream handler called.")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Error("timeserver: Response writer does not support streaming.")
+		w.WriteHeader(http.StatusInternalServerError)
+		renderTemplate(w, "500", nil)
+		return
+	}
+
+	name, _ := getUUIDThenName(r)
+	var prefs people.Prefs
+	if name != "" {
+		prefs = getPrefs(r)
+	}
+
+	d, err := resolveDisplay(r, prefs)
+	if err != nil {
+		log.Warn(err)
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", EVENT_STREAM_CONTENT_TYPE)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	// Tell EventSource to reconnect no sooner than the next tick.
+	fmt.Fprintf(w, "retry: %d\n\n", *config.StreamInt/time.Millisecond)
+
+	ticker := config.Clock.NewTicker(*config.StreamInt)
+	defer ticker.Stop()
+	heartbeat := time.NewTicker(*config.StreamBeat)
+	defer heartbeat.Stop()
+
+	lastWrite := time.Now()
+	send := func(now time.Time) (err error) {
+		var data []byte
+		if data, err = json.Marshal(newTimeResponse(now.In(d.loc), d, name)); err != nil {
+			return
+		}
+		if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", TIME_EVENT, data); err != nil {
+			return
+		}
+		flusher.Flush()
+		lastWrite = time.Now()
+		return
+	}
+
+	if err := send(config.Clock.Now()); err != nil {
+		log.Warn(err)
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Debug("timeserver: Time stream client disconnected.")
+			return
+		case <-shuttingDown:
+			return
+		case <-ticker.C():
+			if err := send(config.Clock.Now()); err != nil {
+				log.Warn(err)
+				return
+			}
+		case <-heartbeat.C:
+			if time.Since(lastWrite) < *config.StreamBeat {
+				continue
+			}
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				log.Warn(err)
+				return
+			}
+			flusher.Flush()
+			lastWrite = time.Now()
+		}
+	}
+}
@@ -0,0 +1,69 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package main
+
+import (
+	"encoding/json"
+	log "github.com/cihub/seelog"
+	"github.com/patkaehuaea/command/config"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	ORIGINATE_PARAM = "t1"
+)
+
+// Timestamps of the NTP four-timestamp model as nanoseconds since
+// the Unix epoch. Client records T1 when sending and T4 when the
+// response arrives, then computes
+//
+//	offset = ((T2 - T1) + (T3 - T4)) / 2
+//	delay  = (T4 - T1) - (T3 - T2)
+//
+// Originate echoes the client's T1 so responses can be matched to
+// requests; it is zero if the client didn't send one.
+type syncResponse struct {
+	Originate    int64  `json:"originate"`
+	Receive      int64  `json:"receive"`
+	Transmit     int64  `json:"transmit"`
+	ReceiveTime  string `json:"receive_time"`
+	TransmitTime string `json:"transmit_time"`
+}
+
+// Returns receive and transmit timestamps for clock synchronization.
+// Not subject to the simulated delay or throttling on /time, which
+// would otherwise show up as asymmetric network delay. Transmit is
+// taken as late as possible, after everything but the write itself.
+func handleSync(w http.ResponseWriter, r *http.Request) {
+	receive := config.Clock.Now()
+	log.Info("timeserver: Sync handler called.")
+
+	resp := syncResponse{Receive: receive.UnixNano(), ReceiveTime: receive.UTC().Format(time.RFC3339Nano)}
+	if t1 := r.URL.Query().Get(ORIGINATE_PARAM); t1 != "" {
+		originate, err := strconv.ParseInt(t1, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "timeserver: t1 must be nanoseconds since the Unix epoch."})
+			return
+		}
+		resp.Originate = originate
+	}
+
+	w.Header().Set("Content-Type", JSON_CONTENT_TYPE)
+	w.Header().Set("Cache-Control", "no-store")
+
+	transmit := config.Clock.Now()
+	resp.Transmit = transmit.UnixNano()
+	resp.TransmitTime = transmit.UTC().Format(time.RFC3339Nano)
+	body, err := json.Marshal(resp)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(body)
+}
@@ -4,31 +4,66 @@
 //  Written by Pat Kaehuaea, February 2015
 //
 // Package contains simple web server that provides '/time' endpoint as
-// well as '/login', '/logout', '/', and 'index.html'. Operations to
-// find a user given a UUID, and create a user are conducted via the
-// client package that abstracts HTTP communication with authserver from
-// this program. Configuration data for btoh timeserver and authserver
-// are exposed in the config pacakge. Timeserver will only throttle
-// requests to the time endpoint and stats are only available if requests
-// are configured to throttle. The latter two features aren't derived from
-// customer use case's but from the desire to simulate load on timeserver.
+// well as '/login', '/logout', '/', and 'index.html'. The time is also
+// available as JSON from '/api/time', or from '/time' when requested
+// with an Accept header of application/json. Either may be given a tz
+// query parameter; otherwise the zone saved from '/profile' or reported
+// by the browser is used. Likewise format and locale query parameters
+// override saved preferences, which override Accept-Language. The
+// '/worldclock' page, and '/api/worldclock', show the time in the zones
+// given by --worldclock-zones and the user's favorite zones. The time
+// page keeps itself current by subscribing to '/time/stream', which
+// pushes the time as Server-Sent Events. Dashboards may instead connect
+// to '/time/ws' and control their subscription over a WebSocket. Test
+// rigs synchronizing clocks use '/api/sync', which returns NTP style
+// receive and transmit timestamps and is never delayed. Clients on the
+// lab network may also use SNTP on the UDP port given by --sntp-port.
+// Operations to find a user given a UUID, and create a user are
+// conducted via the client package that abstracts HTTP communication
+// with authserver from this program. Configuration data for btoh
+// timeserver and authserver are exposed in the config pacakge. Handlers
+// are wrapped per route by a chain of middleware. In-flight requests to
+// the time endpoint are always tracked, but only rejected when
+// --max-inflight is set. Throttling and the simulated delay aren't
+// derived from customer use case's but from the desire to simulate load
+// on timeserver. Simulated latency and faults are described by named
+// profiles from the fault package, assigned per route and switched at
+// runtime through /faults. Metrics, liveness and readiness are served
+// from /metrics, /healthz and /readyz, optionally on a separate admin
+// port; /faults only on the admin port. Given --tls-cert and --tls-key,
+// pages are served over HTTPS with HSTS, and plain HTTP on
+// --redirect-port is redirected there.
 package main
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/cihub/seelog"
 	"github.com/gorilla/mux"
 	"github.com/patkaehuaea/command/authserver/client"
 	"github.com/patkaehuaea/command/authserver/people"
+	"github.com/patkaehuaea/command/authserver/token"
+	"github.com/patkaehuaea/command/certs"
 	"github.com/patkaehuaea/command/config"
+	"github.com/patkaehuaea/command/health"
+	"github.com/patkaehuaea/command/stats"
+	"github.com/patkaehuaea/command/timefmt"
+	"github.com/patkaehuaea/command/timeserver/cache"
 	"github.com/patkaehuaea/command/timeserver/cookie"
-	"github.com/patkaehuaea/command/timeserver/stats"
+	"github.com/patkaehuaea/command/timeserver/fault"
+	"github.com/patkaehuaea/command/timeserver/sntp"
 	"html/template"
-	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -36,38 +71,167 @@ const (
 	VERSION_NUMBER       = "v2.3.2"
 	TEMPL_DIR            = "templates"
 	TEMPL_FILE_EXTENSION = ".tmpl"
-	LOCAL_TIME_LAYOUT    = "3:04:05 PM"
-	UTC_TIME_LAYOUT      = "15:04:05 UTC"
+	AUTH_PROBE_TTL       = 5 * time.Second
+	SHUTDOWN_TIMEOUT     = 10 * time.Second
 )
 
+// Wraps a handler with behaviour common to more than one route.
+// Applied to individual routes with chain().
+type middleware func(http.HandlerFunc) http.HandlerFunc
+
+// Captures status code written by a handler so it can be
+// recorded once the handler returns.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// Passes flush through to underlying writer so that streaming
+// handlers may be instrumented.
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Passes hijack through to underlying writer so that WebSocket
+// upgrades may be instrumented.
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("timeserver: Response writer does not support hijacking.")
+	}
+	sr.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
 var (
-	authClient *client.AuthClient
-	inFlight   *stats.ConcurrentRequests
-	templates  *template.Template
+	authClient   *client.AuthClient
+	authLatency  *stats.HistogramVec
+	canceled     *stats.CounterVec
+	faultCount   *stats.CounterVec
+	faults       *fault.Injector
+	inFlight     *stats.ConcurrentRequests
+	liveness     *health.Checker
+	names        *cache.Cache
+	readiness    *health.Checker
+	registry     *stats.Registry
+	routeLatency *stats.HistogramVec
+	savedPrefs   *cache.Cache
+	sockets      *stats.ConcurrentRequests
+	statusCodes  *stats.CounterVec
+	subscribers  *stats.ConcurrentRequests
+	templates    *template.Template
 )
 
-// Credit: http://goo.gl/MsxPHk
-func delay(average time.Duration, deviation time.Duration) {
-	log.Trace("timeserver: delay average - " + average.String() + " ; " + "delay deviation = " + deviation.String())
-	load := time.Duration(rand.NormFloat64())*deviation + average
-	log.Debug("timeserver: Sleeping for " + load.String() + ".")
-	time.Sleep(load)
+// Closed when the server begins shutting down so that streams and
+// sockets, which would otherwise run indefinitely, can finish.
+// Sockets are counted under socketsLock so that none start once
+// shutdown waits for them.
+var (
+	openSockets  sync.WaitGroup
+	socketsLock  sync.Mutex
+	shuttingDown = make(chan struct{})
+)
+
+// Closes shuttingDown if not already closed.
+func beginShutdown() {
+	socketsLock.Lock()
+	defer socketsLock.Unlock()
+	select {
+	case <-shuttingDown:
+	default:
+		close(shuttingDown)
+	}
+}
+
+// Counts a new socket in openSockets, or returns false if the server
+// is shutting down. Callers must call openSockets.Done() when true.
+func trackSocket() bool {
+	socketsLock.Lock()
+	defer socketsLock.Unlock()
+	select {
+	case <-shuttingDown:
+		return false
+	default:
+	}
+	openSockets.Add(1)
+	return true
+}
+
+// Wraps fn with each middleware such that the first middleware
+// listed is the first to see the request.
+func chain(fn http.HandlerFunc, m ...middleware) http.HandlerFunc {
+	for i := len(m) - 1; i >= 0; i-- {
+		fn = m[i](fn)
+	}
+	return fn
+}
+
+// Readiness check confirming authserver is reachable. Wrapped with
+// readiness.Cached() so that probes don't add load to authserver.
+func checkAuthserver() (detail string, err error) {
+	detail = strings.Join(authClient.Balancer.Addrs(), ", ") + ", " + strconv.Itoa(authClient.Balancer.Healthy()) +
+		" healthy, breaker " + client.BREAKER_STATES[authClient.Breaker.State()]
+	err = authClient.Ping()
+	return
+}
+
+// Returns function finding authserver endpoints, from DNS, a file,
+// --auth-endpoints or else --authhost and --authport, and whether
+// it should be called periodically.
+func authEndpoints() (resolve func() ([]string, error), watch bool) {
+	switch {
+	case *config.AuthSRV != config.AUTH_SRV:
+		return client.SRVResolver(*config.AuthSRV), true
+	case *config.AuthEndptFile != config.AUTH_ENDPT_FILE:
+		return client.FileResolver(*config.AuthEndptFile), true
+	}
+	addrs := []string{*config.AuthHost + *config.AuthPort}
+	if *config.AuthEndpoints != config.AUTH_ENDPOINTS {
+		addrs = strings.Split(*config.AuthEndpoints, ",")
+		for i := range addrs {
+			addrs[i] = strings.TrimSpace(addrs[i])
+		}
+	}
+	return func() ([]string, error) { return addrs, nil }, false
 }
 
 func getUUIDThenName(r *http.Request) (name string, err error) {
 	log.Info("timeserver: Called getUUIDThenName function.")
 
-	var uuid string
-	if uuid, err = cookie.UUID(r); err != nil {
+	if err = simulatedAuthFailure(r); err != nil {
 		log.Warn(err)
 		return
 	}
 
-	if name, err = authClient.Get(uuid); err != nil {
+	var uuid string
+	if uuid, err = cookie.UUID(r); err != nil {
 		log.Warn(err)
 		return
 	}
 
+	// Unknown users are cached as an empty name.
+	var state int
+	name, state = names.Get(uuid)
+	switch state {
+	case cache.STALE:
+		if names.Claim(uuid) {
+			go refreshName(uuid)
+		}
+	case cache.MISS:
+		if name, err = lookupName(r.Context(), uuid); err != nil {
+			log.Warn(err)
+			return
+		}
+		names.Set(uuid, name)
+	}
+
 	// Prevents issues where cookies persists in browser but
 	// does not persist in authserver. Caller should be notified
 	// that authserver contains empty result.
@@ -79,11 +243,40 @@ func getUUIDThenName(r *http.Request) (name string, err error) {
 	return
 }
 
+// Asks authserver for name of user with uuid.
+func lookupName(ctx context.Context, uuid string) (name string, err error) {
+	start := time.Now()
+	name, err = authClient.GetContext(ctx, uuid)
+	authLatency.With("get").ObserveSince(start)
+	return
+}
+
+// Replaces stale cached name of user with uuid. Stale name is kept
+// if authserver can't be reached, so that users aren't logged out
+// while it is unavailable.
+func refreshName(uuid string) {
+	ctx, cancel := context.WithTimeout(context.Background(), *config.AuthTimeoutMS)
+	defer cancel()
+	name, err := lookupName(ctx, uuid)
+	if err != nil {
+		log.Warn(err)
+		names.Release(uuid)
+		return
+	}
+	names.Set(uuid, name)
+}
+
 func handleDefault(w http.ResponseWriter, r *http.Request) {
 	log.Info("timeserver: Default handler called.")
 
 	name, err := getUUIDThenName(r)
 
+	// Users stay logged in while authserver is unavailable and
+	// are shown the time anonymously.
+	if errors.Is(err, client.ErrUnavailable) {
+		http.Redirect(w, r, "/time", http.StatusFound)
+		return
+	}
 	if err != nil {
 		http.SetCookie(w, cookie.NewCookie(cookie.DELETE_VALUE, cookie.DELETE_AGE))
 		http.Redirect(w, r, "/login", http.StatusFound)
@@ -108,7 +301,10 @@ func handleProcessLogin(w http.ResponseWriter, r *http.Request) {
 		log.Trace("timeserver: Name matched regex.")
 		uuid := people.UUID()
 
-		if err := authClient.Set(uuid, name); err != nil {
+		start := time.Now()
+		err := authClient.SetContext(r.Context(), uuid, name)
+		authLatency.With("set").ObserveSince(start)
+		if err != nil {
 			http.SetCookie(w, cookie.NewCookie(cookie.DELETE_VALUE, cookie.DELETE_AGE))
 			w.WriteHeader(http.StatusInternalServerError)
 			renderTemplate(w, "500", nil)
@@ -116,6 +312,8 @@ func handleProcessLogin(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		names.Set(uuid, name)
+		cachePrefs(uuid, people.Prefs{})
 		http.SetCookie(w, cookie.NewCookie(uuid, cookie.MAX_AGE))
 		http.Redirect(w, r, "/", http.StatusFound)
 		log.Info("timeserver: " + name + " registered on site.")
@@ -130,10 +328,122 @@ func handleProcessLogin(w http.ResponseWriter, r *http.Request) {
 func handleLogout(w http.ResponseWriter, r *http.Request) {
 	log.Info("timeserver: Logout handler called.")
 
+	if uuid, err := cookie.UUID(r); err == nil {
+		names.Delete(uuid)
+		savedPrefs.Delete(uuid)
+	}
+
 	http.SetCookie(w, cookie.NewCookie(cookie.DELETE_VALUE, cookie.DELETE_AGE))
 	renderTemplate(w, "logged-out", nil)
 }
 
+// Shows preferences of logged in user. Anonymous users are sent to
+// login page as there is nowhere to save preferences. Fails with 503
+// rather than logging the user out if authserver is unavailable.
+func handleDisplayProfile(w http.ResponseWriter, r *http.Request) {
+	log.Info("timeserver: Display profile handler called.")
+
+	name, err := getUUIDThenName(r)
+	if errors.Is(err, client.ErrUnavailable) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		renderTemplate(w, "500", nil)
+		return
+	}
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	params := map[string]interface{}{
+		"name":    name,
+		"prefs":   getPrefs(r),
+		"formats": timefmt.NAMES,
+		"locales": timefmt.LOCALES,
+	}
+	renderTemplate(w, "profile", params)
+}
+
+func handleProcessProfile(w http.ResponseWriter, r *http.Request) {
+	log.Info("timeserver: Process profile handler called.")
+
+	name, err := getUUIDThenName(r)
+	if errors.Is(err, client.ErrUnavailable) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		renderTemplate(w, "500", nil)
+		return
+	}
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	uuid, _ := cookie.UUID(r)
+
+	// Custom layout, when given, takes the place of a named format.
+	prefs := people.Prefs{
+		TZ:     r.FormValue(TZ_PARAM),
+		Format: r.FormValue(FORMAT_PARAM),
+		Locale: r.FormValue(LOCALE_PARAM),
+		Zones:  people.SplitZones(r.FormValue("zones")),
+	}
+	if custom := r.FormValue("layout"); custom != "" {
+		prefs.Format = custom
+	}
+	params := map[string]interface{}{
+		"name":    name,
+		"prefs":   prefs,
+		"formats": timefmt.NAMES,
+		"locales": timefmt.LOCALES,
+	}
+
+	if !people.IsValidTZ(prefs.TZ) {
+		w.WriteHeader(http.StatusBadRequest)
+		params["error"] = zoneError{name: prefs.TZ}.Error()
+		renderTemplate(w, "profile", params)
+		log.Warn("timeserver: Invalid time zone submitted to profile.")
+		return
+	}
+
+	for _, zone := range prefs.Zones {
+		if !people.IsValidTZ(zone) {
+			w.WriteHeader(http.StatusBadRequest)
+			params["error"] = zoneError{name: zone}.Error()
+			renderTemplate(w, "profile", params)
+			log.Warn("timeserver: Invalid favorite zone submitted to profile.")
+			return
+		}
+	}
+
+	if _, err := timefmt.Layout(prefs.Format); prefs.Format != "" && err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		params["error"] = err.Error()
+		renderTemplate(w, "profile", params)
+		log.Warn("timeserver: Invalid format submitted to profile.")
+		return
+	}
+
+	if !timefmt.IsSupported(prefs.Locale) {
+		w.WriteHeader(http.StatusBadRequest)
+		params["error"] = "timeserver: Unsupported locale."
+		renderTemplate(w, "profile", params)
+		log.Warn("timeserver: Invalid locale submitted to profile.")
+		return
+	}
+
+	start := time.Now()
+	err = authClient.SetPrefsContext(r.Context(), uuid, prefs)
+	authLatency.With("setprefs").ObserveSince(start)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		renderTemplate(w, "500", nil)
+		log.Error(err)
+		return
+	}
+	cachePrefs(uuid, prefs)
+
+	params["message"] = "Preferences saved."
+	renderTemplate(w, "profile", params)
+}
+
 func handleNotFound(w http.ResponseWriter, r *http.Request) {
 	log.Info("timeserver: Not found handler called.")
 
@@ -141,28 +451,145 @@ func handleNotFound(w http.ResponseWriter, r *http.Request) {
 	renderTemplate(w, "404", nil)
 }
 
+// Serves HTML time page unless client prefers JSON.
 func handleTime(w http.ResponseWriter, r *http.Request) {
 	log.Info("timeserver: Time handler called.")
+	w.Header().Set("Vary", "Accept")
+	serveTime(w, r, acceptsJSON(r))
+}
 
-	// Simulate load with delay function.
-	delay(*config.AvgRespMS, *config.DeviationMS)
-
+// Shared by /time and /api/time so that both are subject to the
+// same cookie handling.
+func serveTime(w http.ResponseWriter, r *http.Request, asJSON bool) {
+	// Page is rendered anonymously if authserver is unavailable,
+	// but cookie is only cleared if the user is unknown.
 	name, err := getUUIDThenName(r)
 
-	if err != nil {
+	if err != nil && !errors.Is(err, client.ErrUnavailable) {
 		http.SetCookie(w, cookie.NewCookie(cookie.DELETE_VALUE, cookie.DELETE_AGE))
 	}
 
+	var prefs people.Prefs
+	if name != "" {
+		prefs = getPrefs(r)
+	}
+
+	d, err := resolveDisplay(r, prefs)
+	if err != nil {
+		log.Warn(err)
+		if asJSON {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(w, "time", map[string]interface{}{"error": err.Error(), "name": name})
+		return
+	}
+
+	now := config.Clock.Now().In(d.loc)
+	if asJSON {
+		writeJSON(w, http.StatusOK, newTimeResponse(now, d, name))
+		return
+	}
+
 	// If name is blank, template will not render
 	// personalized greeting.
 	params := map[string]interface{}{
-		"localTime": time.Now().Format(LOCAL_TIME_LAYOUT),
-		"UTCTime":   time.Now().Format(UTC_TIME_LAYOUT),
+		"localTime": d.local(now),
+		"UTCTime":   d.utc(now),
+		"zone":      zoneName(now),
 		"name":      name,
 	}
 	renderTemplate(w, "time", params)
 }
 
+// Returns middleware applying the fault profile assigned to route:
+// delays the request, then may drop the connection, fail with an
+// error status or trickle the response body. Headers given by the
+// client may override the profile when --simulate-headers is set.
+// Should follow throttle() so that delayed requests count as in flight.
+func inject(route string) middleware {
+	return func(fn http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			name, profile := faults.Profile(route)
+			o, err := simulateOutcome(r, profile.Sample())
+			if err != nil {
+				log.Warn(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if o.Delay > 0 {
+				log.Debug("timeserver: Profile " + name + " sleeping for " + o.Delay.String() + ".")
+				select {
+				case <-config.Clock.After(o.Delay):
+				case <-r.Context().Done():
+					log.Info("timeserver: Request to " + route + " abandoned during delay, " + r.Context().Err().Error() + ".")
+					canceled.With(route).Inc()
+
+					// Client is still waiting if only the budget
+					// ran out.
+					if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						renderTemplate(w, "500", nil)
+					}
+					return
+				}
+			}
+
+			// Aborting the handler closes the connection without
+			// writing a response.
+			if o.Drop {
+				log.Debug("timeserver: Profile " + name + " dropping connection.")
+				faultCount.With(route, "drop").Inc()
+				panic(http.ErrAbortHandler)
+			}
+			if o.Status != 0 {
+				log.Debug("timeserver: Profile " + name + " failing request.")
+				faultCount.With(route, strconv.Itoa(o.Status)).Inc()
+				w.WriteHeader(o.Status)
+				renderTemplate(w, "500", nil)
+				return
+			}
+			if o.BodyRate > 0 {
+				faultCount.With(route, "slow_body").Inc()
+				w = fault.SlowWriter(w, o.BodyRate, config.Clock.Sleep)
+			}
+			fn(w, r)
+		}
+	}
+}
+
+// Returns middleware bounding the wrapped handler, and calls it
+// makes to authserver, to d from when the request arrived. A d of
+// zero leaves the request unbounded. Not for streaming routes.
+func deadline(d time.Duration) middleware {
+	return func(fn http.HandlerFunc) http.HandlerFunc {
+		if d == 0 {
+			return fn
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			fn(w, r.WithContext(ctx))
+		}
+	}
+}
+
+// Returns middleware recording latency and status code of each
+// request under route. Should be first in chain so that time spent
+// in other middleware, and requests they reject, are counted.
+func instrument(route string) middleware {
+	return func(fn http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			fn(sr, r)
+			routeLatency.With(route).ObserveSince(start)
+			statusCodes.With(route, strconv.Itoa(sr.status)).Inc()
+		}
+	}
+}
+
 // credit: http://tinyurl.com/kwc4hls
 func logFileRequest(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -180,26 +607,67 @@ func renderTemplate(w http.ResponseWriter, templ string, d interface{}) {
 	}
 }
 
-func throttle(fn func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-
-		if err := inFlight.Add(); err != nil {
-			log.Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			renderTemplate(w, "500", nil)
-			return
+// Returns middleware that counts requests against cr for the
+// duration of the wrapped handler. Requests are rejected when cr
+// reports its limit has been reached.
+func throttle(cr *stats.ConcurrentRequests) middleware {
+	return func(fn http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+
+			if err := cr.Add(); err != nil {
+				log.Error(err)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				renderTemplate(w, "503", nil)
+				return
+			}
+
+			// Only subtract if stat was incrememted otherwise
+			// may attempt to subtract below stats.MIN_VALUE.
+			defer func() {
+				if err := cr.Subtract(); err != nil {
+					log.Error(err)
+				}
+			}()
+			fn(w, r)
 		}
+	}
+}
 
-		fn(w, r)
-		// Only subtract if stat was incrememted otherwise
-		// may attempt to subtract below stats.MIN_VALUE.
-		if err := inFlight.Subtract(); err != nil {
-			log.Error(err)
-		}
+// Waits for SIGINT or SIGTERM then stops accepting connections.
+// Streams and sockets are told to finish through shuttingDown, and
+// all requests are given SHUTDOWN_TIMEOUT to complete. Closes done
+// once shutdown is complete.
+func shutdownOnSignal(server *http.Server, done chan<- struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Info("timeserver: Received " + sig.String() + ", shutting down.")
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error(err)
 	}
+
+	// Shutdown() closes shuttingDown in the background; closing it here
+	// ensures no socket is counted once Wait() begins.
+	beginShutdown()
+	socketsClosed := make(chan struct{})
+	go func() {
+		openSockets.Wait()
+		close(socketsClosed)
+	}()
+	select {
+	case <-socketsClosed:
+	case <-ctx.Done():
+		log.Warn("timeserver: Timed out waiting for sockets to close.")
+	}
+	close(done)
 }
 
-func init() {
+// Loads templates and builds the authserver client, caches, fault
+// injector and metrics from parsed flags.
+func setup() {
 
 	// Restrict parsing to *.templ to prevent fail on non-template files in a given directory
 	// like .DS_STORE.
@@ -211,47 +679,287 @@ func init() {
 
 	log.ReplaceLogger(config.Logger)
 	authClient = client.NewAuthClient(*config.AuthHost, *config.AuthPort, *config.AuthTimeoutMS)
+	transport := client.TransportOptions{
+		MaxIdlePerHost: *config.AuthMaxIdle,
+		IdleTimeout:    *config.AuthIdleTime,
+		DialTimeout:    *config.AuthDialTime,
+		TLSTimeout:     *config.AuthTLSTime,
+		Protocol:       *config.AuthProtocol,
+	}
+	if *config.AuthCA != config.AUTH_CA || *config.AuthCert != config.AUTH_CERT {
+		reloader, err := certs.NewReloader(*config.AuthCert, *config.AuthKey, *config.AuthCA)
+		if err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+		go reloader.Watch(*config.CertReload, shuttingDown)
+		transport.TLSConfig = reloader.ClientConfig()
+	}
+	if err := authClient.UseTransport(transport); err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+	authClient.MaxRetries = *config.AuthRetries
+	authClient.Backoff = *config.AuthBackoff
+	authClient.Breaker = client.NewBreaker(*config.BreakerThresh, *config.BreakerCool)
+	resolve, watch := authEndpoints()
+	addrs, err := resolve()
+	if err == nil && len(addrs) == 0 {
+		err = client.ErrNoEndpoints
+	}
+	if err == nil {
+		authClient.Balancer, err = client.NewBalancer(*config.AuthBalance, addrs)
+	}
+	if err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+	authClient.Balancer.EjectAfter = *config.AuthEjectAt
+	authClient.Balancer.EjectFor = *config.AuthEjectTime
+	if watch {
+		go authClient.Balancer.Watch(resolve, *config.AuthResolve, shuttingDown)
+	}
+	if *config.ServiceKeys != config.SERVICE_KEYS {
+		if authClient.Keys, err = token.NewKeyring(*config.ServiceKeys); err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+		go authClient.Keys.Watch(*config.CertReload, shuttingDown)
+	}
+	names = cache.New(*config.NameCacheSize, *config.NameCacheTTL, *config.NameCacheNeg, *config.NameStale)
+	savedPrefs = cache.New(*config.NameCacheSize, *config.NameCacheTTL, *config.NameCacheNeg, *config.NameStale)
+
+	// Tracking is always enabled; stats.NO_LIMIT disables rejection.
+	inFlight = stats.NewCR(*config.MaxInFlight)
+	subscribers = stats.NewCR(*config.MaxSubs)
+	sockets = stats.NewCR(*config.MaxSubs)
+	authLatency = stats.NewHistogramVec(stats.DEFAULT_BUCKETS, "op")
+	routeLatency = stats.NewHistogramVec(stats.DEFAULT_BUCKETS, "route")
+	statusCodes = stats.NewCounterVec("route", "code")
+	faultCount = stats.NewCounterVec("route", "fault")
+	canceled = stats.NewCounterVec("route")
+
+	// Default profile reproduces the delay /time has always had,
+	// now truncated at zero, and applies to both time routes.
+	faults = fault.NewInjector(fault.Profile{
+		Distribution: fault.DIST_NORMAL,
+		Mean:         fault.Duration(*config.AvgRespMS),
+		Deviation:    fault.Duration(*config.DeviationMS),
+	})
+	faults.Apply(fault.Config{Routes: map[string]string{"time": fault.DEFAULT, "api_time": fault.DEFAULT}})
+	if *config.FaultProfiles != config.FAULT_PROFILES {
+		if err := faults.Load(*config.FaultProfiles); err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+	}
+
+	liveness = health.NewChecker(VERSION_NUMBER)
+	readiness = health.NewChecker(VERSION_NUMBER)
+	readiness.Add("authserver", readiness.Cached(checkAuthserver, AUTH_PROBE_TTL))
+
+	registry = stats.NewRegistry()
+	registry.CounterVec("timeserver_requests_total", "Requests by route and status code.", statusCodes)
+	registry.HistogramVec("timeserver_request_duration_seconds", "Time taken to serve requests by route.", routeLatency)
+	registry.GaugeFunc("timeserver_time_inflight_requests", "Requests to /time currently being served.", func() float64 { return float64(inFlight.Current()) })
+	registry.GaugeFunc("timeserver_time_inflight_max", "Limit on concurrent /time requests, zero if unlimited.", func() float64 { return float64(inFlight.Max()) })
+	registry.CounterFunc("timeserver_throttle_rejected_total", "Requests to /time rejected by throttling.", func() float64 { return float64(inFlight.Rejected()) })
+	registry.GaugeFunc("timeserver_stream_subscribers", "Clients subscribed to /time/stream.", func() float64 { return float64(subscribers.Current()) })
+	registry.CounterFunc("timeserver_stream_rejected_total", "Subscriptions to /time/stream rejected by --max-subscribers.", func() float64 { return float64(subscribers.Rejected()) })
+	registry.GaugeFunc("timeserver_websocket_connections", "Open connections to /time/ws.", func() float64 { return float64(sockets.Current()) })
+	registry.CounterFunc("timeserver_websocket_rejected_total", "Connections to /time/ws rejected by --max-subscribers.", func() float64 { return float64(sockets.Rejected()) })
+	registry.CounterVec("timeserver_requests_abandoned_total", "Requests whose client disconnected or budget ran out during the simulated delay.", canceled)
+	registry.CounterVec("timeserver_faults_injected_total", "Faults injected by route and kind.", faultCount)
+	registry.HistogramVec("timeserver_auth_request_duration_seconds", "Time taken by calls to authserver by operation.", authLatency)
+	registry.CounterFunc("timeserver_name_cache_hits_total", "Names found fresh in cache.", func() float64 { return float64(names.Hits.Value()) })
+	registry.CounterFunc("timeserver_name_cache_stale_hits_total", "Names served from cache after expiry while being refreshed.", func() float64 { return float64(names.StaleHits.Value()) })
+	registry.CounterFunc("timeserver_name_cache_misses_total", "Names looked up from authserver.", func() float64 { return float64(names.Misses.Value()) })
+	registry.CounterFunc("timeserver_name_cache_evictions_total", "Names evicted to keep cache within --name-cache-size.", func() float64 { return float64(names.Evictions.Value()) })
+	registry.GaugeFunc("timeserver_name_cache_entries", "Names held in cache.", func() float64 { return float64(names.Len()) })
+	registry.CounterVec("timeserver_auth_canceled_total", "Calls to authserver abandoned by operation and reason.", authClient.Canceled)
+	registry.CounterFunc("timeserver_auth_retries_total", "Calls to authserver retried.", func() float64 { return float64(authClient.Retried.Value()) })
+	registry.GaugeFunc("timeserver_auth_breaker_state", "Authserver circuit breaker: 0 closed, 1 half-open, 2 open.", func() float64 { return float64(authClient.Breaker.State()) })
+	registry.CounterFunc("timeserver_auth_breaker_trips_total", "Times the authserver circuit breaker opened.", func() float64 { return float64(authClient.Breaker.Trips()) })
+	registry.GaugeFunc("timeserver_auth_endpoints", "Authserver endpoints calls are spread across.", func() float64 { return float64(len(authClient.Balancer.Addrs())) })
+	registry.GaugeFunc("timeserver_auth_endpoints_healthy", "Authserver endpoints not currently ejected.", func() float64 { return float64(authClient.Balancer.Healthy()) })
+	registry.CounterVec("timeserver_auth_ejections_total", "Authserver endpoints ejected after repeated failures, by endpoint.", authClient.Balancer.Ejected)
+	registry.CounterFunc("timeserver_auth_breaker_rejected_total", "Calls to authserver failed fast by the circuit breaker.", func() float64 { return float64(authClient.Breaker.Rejected()) })
 }
 
 func main() {
 
 	/*
 		Paramters surfaced via config pacakge used in this program:
+		*config.AdminPort
 		*config.AuthHost
+		*config.AuthBackoff
+		*config.AuthBalance
+		*config.AuthCA
+		*config.AuthCert
+		*config.AuthDialTime
+		*config.AuthEjectAt
+		*config.AuthEjectTime
+		*config.AuthEndpoints
+		*config.AuthEndptFile
+		*config.AuthIdleTime
+		*config.AuthKey
+		*config.AuthMaxIdle
 		*config.AuthPort
+		*config.AuthProtocol
+		*config.AuthResolve
+		*config.AuthRetries
+		*config.AuthSRV
 		*config.AuthTimeoutMS
+		*config.AuthTLSTime
 		*config.AvgRespMS
+		*config.BreakerCool
+		*config.BreakerThresh
+		*config.CertReload
 		*config.DeviationMS
+		*config.FaultProfiles
+		*config.HSTSMaxAge
 		*config.LogConf
 		config.Logger
 		*config.MaxInFlight
+		*config.MaxSubs
+		*config.NameCacheNeg
+		*config.NameCacheSize
+		*config.NameCacheTTL
+		*config.NameStale
+		*config.RedirectPort
+		*config.ServiceKeys
+		*config.ReqTimeout
+		*config.SimHeaders
+		*config.SNTPBurst
+		*config.SNTPPort
+		*config.SNTPRate
+		*config.SNTPStratum
+		*config.StreamBeat
+		*config.StreamInt
 		*config.TimePort
+		*config.TLSCert
+		*config.TLSKey
 		*config.TmplDir
 		*config.Verbose
+		*config.WorldZones
 	*/
 
+	config.Parse()
 	if *config.Verbose {
 		fmt.Printf("Version number: %s \n", VERSION_NUMBER)
 		os.Exit(0)
 	}
+	setup()
+
+	// Streaming routes are exempt as they run until the client leaves.
+	budget := deadline(*config.ReqTimeout)
 
 	r := mux.NewRouter()
-	r.HandleFunc("/", handleDefault)
-	r.PathPrefix("/css/").Handler(logFileRequest(http.StripPrefix("/css/", http.FileServer(http.Dir("css/")))))
-	r.HandleFunc("/index.html", handleDefault)
-	r.HandleFunc("/login", handleDisplayLogin).Methods("GET")
-	r.HandleFunc("/login", handleProcessLogin).Methods("POST")
-	r.HandleFunc("/logout", handleLogout)
-	if *config.MaxInFlight != 0 {
+	files := logFileRequest(http.StripPrefix("/css/", http.FileServer(http.Dir("css/"))))
+	r.HandleFunc("/", chain(handleDefault, instrument("default"), budget, inject("default")))
+	r.PathPrefix("/css/").Handler(chain(files.ServeHTTP, instrument("css")))
+	r.HandleFunc("/index.html", chain(handleDefault, instrument("default"), budget, inject("default")))
+	r.HandleFunc("/login", chain(handleDisplayLogin, instrument("login"), budget, inject("login"))).Methods("GET")
+	r.HandleFunc("/login", chain(handleProcessLogin, instrument("login"), budget, inject("login"))).Methods("POST")
+	r.HandleFunc("/logout", chain(handleLogout, instrument("logout"), budget, inject("logout")))
+	r.HandleFunc("/profile", chain(handleDisplayProfile, instrument("profile"), budget, inject("profile"))).Methods("GET")
+	r.HandleFunc("/profile", chain(handleProcessProfile, instrument("profile"), budget, inject("profile"))).Methods("POST")
+	if *config.MaxInFlight != stats.NO_LIMIT {
 		log.Infof("%s - %d", "timeserver: Max concurrent time connections", *config.MaxInFlight)
-		inFlight = stats.NewCR(*config.MaxInFlight)
-		r.HandleFunc("/time", throttle(handleTime))
 	}
-	r.HandleFunc("/time", handleTime)
-	r.NotFoundHandler = http.HandlerFunc(handleNotFound)
-	http.Handle("/", r)
-	if err := (http.ListenAndServe(*config.TimePort, nil)); err != nil {
+	r.HandleFunc("/time", chain(handleTime, instrument("time"), throttle(inFlight), budget, inject("time")))
+	r.HandleFunc("/time/stream", chain(handleTimeStream, instrument("time_stream"), throttle(subscribers), inject("time_stream"))).Methods("GET")
+	r.HandleFunc("/time/ws", chain(handleTimeSocket, instrument("time_ws"), throttle(sockets), inject("time_ws"))).Methods("GET")
+	r.HandleFunc("/api/time", chain(handleAPITime, instrument("api_time"), throttle(inFlight), budget, inject("api_time"))).Methods("GET")
+	r.HandleFunc("/api/sync", chain(handleSync, instrument("api_sync"))).Methods("GET")
+	r.HandleFunc("/worldclock", chain(handleWorldClock, instrument("worldclock"), budget, inject("worldclock"))).Methods("GET")
+	r.HandleFunc("/api/worldclock", chain(handleAPIWorldClock, instrument("api_worldclock"), budget, inject("api_worldclock"))).Methods("GET")
+	r.NotFoundHandler = chain(handleNotFound, instrument("notfound"))
+
+	// Admin endpoints share the main router unless a separate
+	// port is configured.
+	admin := r
+	if *config.AdminPort != config.ADMIN_PORT {
+		admin = mux.NewRouter()
+		go func() {
+			if err := http.ListenAndServe(*config.AdminPort, admin); err != nil {
+				log.Critical(err)
+				os.Exit(1)
+			}
+		}()
+	}
+	admin.Handle("/metrics", registry).Methods("GET")
+	admin.Handle("/healthz", liveness).Methods("GET")
+	admin.Handle("/readyz", readiness).Methods("GET")
+
+	// Changing fault profiles can take the site down, so it is never
+	// offered to visitors on the main port.
+	if admin != r {
+		admin.Handle("/faults", faults).Methods("GET", "POST")
+	}
+
+	var sntpServer *sntp.Server
+	if *config.SNTPPort != config.SNTP_PORT {
+		var err error
+		if sntpServer, err = sntp.NewServer(*config.SNTPStratum, *config.SNTPRate, *config.SNTPBurst); err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+		sntpServer.Clock = config.Clock
+		registry.CounterVec("timeserver_sntp_requests_total", "SNTP requests by result.", sntpServer.Requests)
+		go func() {
+			if err := sntpServer.ListenAndServe(*config.SNTPPort); err != nil {
+				log.Critical(err)
+				os.Exit(1)
+			}
+		}()
+		log.Info("timeserver: Serving SNTP on " + *config.SNTPPort)
+	}
+
+	server := &http.Server{Addr: *config.TimePort}
+	server.RegisterOnShutdown(beginShutdown)
+	if sntpServer != nil {
+		server.RegisterOnShutdown(func() { sntpServer.Close() })
+	}
+
+	// Serving TLS makes cookies Secure, adds HSTS and, optionally,
+	// redirects plain HTTP.
+	var handler http.Handler = r
+	serve := server.ListenAndServe
+	if *config.TLSCert != config.TLS_CERT {
+		reloader, err := certs.NewReloader(*config.TLSCert, *config.TLSKey, "")
+		if err != nil {
+			log.Critical(err)
+			os.Exit(1)
+		}
+		go reloader.Watch(*config.CertReload, shuttingDown)
+		go reloadOnHangup(reloader)
+		server.TLSConfig = reloader.ServerConfig(false)
+		serve = func() error { return server.ListenAndServeTLS("", "") }
+		cookie.Secure = true
+		if *config.HSTSMaxAge > 0 {
+			handler = hsts(r, *config.HSTSMaxAge)
+		}
+
+		if *config.RedirectPort != config.REDIRECT_PORT {
+			redirect := &http.Server{Addr: *config.RedirectPort, Handler: http.HandlerFunc(handleRedirect)}
+			server.RegisterOnShutdown(func() { redirect.Close() })
+			go func() {
+				if err := redirect.ListenAndServe(); err != http.ErrServerClosed {
+					log.Critical(err)
+					os.Exit(1)
+				}
+			}()
+		}
+	}
+	http.Handle("/", handler)
+
+	done := make(chan struct{})
+	go shutdownOnSignal(server, done)
+	if err := serve(); err != http.ErrServerClosed {
 		log.Critical(err)
 		os.Exit(1)
 	}
+	<-done
+	log.Flush()
 }
@@ -0,0 +1,63 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package main
+
+import (
+	"github.com/patkaehuaea/command/stats"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Sets up as main() does, with default flags.
+func TestMain(m *testing.M) {
+	setup()
+	os.Exit(m.Run())
+}
+
+func TestThrottleRejectsBeyondMax(t *testing.T) {
+	const max = 3
+	cr := stats.NewCR(max)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := throttle(cr)(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+
+	var served sync.WaitGroup
+	for i := 0; i < max; i++ {
+		served.Add(1)
+		go func() {
+			defer served.Done()
+			handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/time", nil))
+		}()
+	}
+	for i := 0; i < max; i++ {
+		<-started
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/time", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("request %d got %d, want %d", max+1, w.Code, http.StatusServiceUnavailable)
+	}
+	if !strings.Contains(w.Body.String(), "too busy") {
+		t.Errorf("rejection body missing 503 page: %q", w.Body.String())
+	}
+	if got := cr.Rejected(); got != 1 {
+		t.Errorf("Rejected() = %d, want 1", got)
+	}
+
+	close(release)
+	served.Wait()
+	if got := cr.Current(); got != 0 {
+		t.Errorf("Current() = %d after requests finished, want 0", got)
+	}
+}
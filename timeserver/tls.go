@@ -0,0 +1,68 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package main
+
+import (
+	log "github.com/cihub/seelog"
+	"github.com/patkaehuaea/command/certs"
+	"github.com/patkaehuaea/command/config"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	HTTPS_PORT = "443"
+)
+
+// Wraps h so that every response tells browsers to use HTTPS for
+// maxAge. Only for handlers served over TLS.
+func hsts(h http.Handler, maxAge time.Duration) http.Handler {
+	value := "max-age=" + strconv.Itoa(int(maxAge/time.Second))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Redirects plain HTTP requests to the same path on the HTTPS
+// listener at --port.
+func handleRedirect(w http.ResponseWriter, r *http.Request) {
+	log.Info("timeserver: Redirect handler called.")
+
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if _, port, err := net.SplitHostPort(*config.TimePort); err == nil && port != HTTPS_PORT {
+		host = net.JoinHostPort(host, port)
+	}
+	target := "https://" + host + r.URL.RequestURI()
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
+
+// Reloads certificates whenever SIGHUP is received, in addition to
+// the periodic check for changed files.
+func reloadOnHangup(reloader *certs.Reloader) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for {
+		select {
+		case <-signals:
+			log.Info("timeserver: Received SIGHUP, reloading certificates.")
+			if err := reloader.Reload(); err != nil {
+				log.Error("timeserver: Keeping previous certificates: ", err)
+			}
+		case <-shuttingDown:
+			signal.Stop(signals)
+			return
+		}
+	}
+}
@@ -0,0 +1,131 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package main
+
+import (
+	log "github.com/cihub/seelog"
+	"github.com/patkaehuaea/command/authserver/people"
+	"github.com/patkaehuaea/command/config"
+	"net/http"
+	"time"
+)
+
+// Time in a single zone of the world clock. Zones that fail to load
+// are kept in the list with Error set so the rest still render.
+type clockEntry struct {
+	Zone         string `json:"zone"`
+	Time         string `json:"time,omitempty"`
+	Formatted    string `json:"formatted,omitempty"`
+	Abbreviation string `json:"abbreviation,omitempty"`
+	Offset       string `json:"utc_offset,omitempty"`
+	DST          bool   `json:"dst"`
+	Favorite     bool   `json:"favorite"`
+	Error        string `json:"error,omitempty"`
+}
+
+type worldClockResponse struct {
+	UTC    string       `json:"utc"`
+	Locale string       `json:"locale"`
+	Zones  []clockEntry `json:"zones"`
+	Name   string       `json:"name,omitempty"`
+}
+
+// Returns now in zone, formatted for display. Unknown zones are
+// reported through the entry's Error field.
+func newClockEntry(now time.Time, d display, zone string) (entry clockEntry) {
+	entry.Zone = zone
+	loc, err := loadLocation(zone)
+	if err != nil {
+		log.Warn(err)
+		entry.Error = err.Error()
+		return
+	}
+
+	entry = clockEntryAt(now.In(loc), d, zone)
+	return
+}
+
+// Returns entry for t, which must already be in the zone's location.
+func clockEntryAt(t time.Time, d display, zone string) (entry clockEntry) {
+	entry.Zone = zone
+	entry.Time = t.Format(time.RFC3339)
+	entry.Formatted = d.render(t)
+	entry.Abbreviation, _ = t.Zone()
+	entry.Offset = t.Format("-07:00")
+	entry.DST = t.IsDST()
+	return
+}
+
+// Returns entry for every configured zone followed by the user's
+// favorites. A zone in both lists is shown once, as a favorite.
+func worldClock(now time.Time, d display, favorites []string) (entries []clockEntry) {
+	isFavorite := make(map[string]bool)
+	for _, zone := range favorites {
+		isFavorite[zone] = true
+	}
+
+	seen := make(map[string]bool)
+	for _, zone := range append(people.SplitZones(*config.WorldZones), favorites...) {
+		if seen[zone] {
+			continue
+		}
+		seen[zone] = true
+
+		entry := newClockEntry(now, d, zone)
+		entry.Favorite = isFavorite[zone]
+		entries = append(entries, entry)
+	}
+	return
+}
+
+// Serves HTML world clock unless client prefers JSON.
+func handleWorldClock(w http.ResponseWriter, r *http.Request) {
+	log.Info("timeserver: World clock handler called.")
+	w.Header().Set("Vary", "Accept")
+	serveWorldClock(w, r, acceptsJSON(r))
+}
+
+func handleAPIWorldClock(w http.ResponseWriter, r *http.Request) {
+	log.Info("timeserver: API world clock handler called.")
+	serveWorldClock(w, r, true)
+}
+
+// Unlike serveTime, a stale or missing cookie is left alone; the
+// world clock is useful without logging in.
+func serveWorldClock(w http.ResponseWriter, r *http.Request, asJSON bool) {
+	name, _ := getUUIDThenName(r)
+
+	var prefs people.Prefs
+	if name != "" {
+		prefs = getPrefs(r)
+	}
+
+	d, err := resolveDisplay(r, prefs)
+	if err != nil {
+		log.Warn(err)
+		if asJSON {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(w, "worldclock", map[string]interface{}{"error": err.Error(), "name": name})
+		return
+	}
+
+	now := config.Clock.Now()
+	entries := worldClock(now, d, prefs.Zones)
+	if asJSON {
+		writeJSON(w, http.StatusOK, worldClockResponse{UTC: now.UTC().Format(time.RFC3339), Locale: d.locale, Zones: entries, Name: name})
+		return
+	}
+
+	params := map[string]interface{}{
+		"UTCTime": d.utc(now),
+		"zones":   entries,
+		"name":    name,
+	}
+	renderTemplate(w, "worldclock", params)
+}
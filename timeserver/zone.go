@@ -0,0 +1,149 @@
+//  Copyright (C) Pat Kaehuaea - All Rights Reserved
+//  Unauthorized copying of this file, via any medium is strictly prohibited
+//  Proprietary and confidential
+//  Written by Pat Kaehuaea, March 2015
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/cihub/seelog"
+	"github.com/patkaehuaea/command/authserver/people"
+	"github.com/patkaehuaea/command/config"
+	"github.com/patkaehuaea/command/timeserver/cache"
+	"github.com/patkaehuaea/command/timeserver/cookie"
+	"net/http"
+	"time"
+)
+
+const (
+	TZ_PARAM = "tz"
+)
+
+// Returned when a zone name is not in the IANA time zone database.
+type zoneError struct {
+	name string
+}
+
+func (e zoneError) Error() string {
+	return fmt.Sprintf("timeserver: Unknown time zone %q. Expected a name such as America/Los_Angeles.", e.name)
+}
+
+func loadLocation(name string) (loc *time.Location, err error) {
+	if loc, err = time.LoadLocation(name); err != nil {
+		err = zoneError{name: name}
+	}
+	return
+}
+
+// Determines zone used to render the time for request. Order of
+// precedence is the tz query parameter, the user's saved preference,
+// the offset reported by the browser, and finally the server's zone.
+// Only an invalid tz parameter is reported as error; an invalid saved
+// preference is logged and skipped.
+func location(r *http.Request, prefs people.Prefs) (loc *time.Location, err error) {
+	if tz := r.URL.Query().Get(TZ_PARAM); tz != "" {
+		return loadLocation(tz)
+	}
+
+	if prefs.TZ != "" {
+		if loc, err = loadLocation(prefs.TZ); err == nil {
+			return
+		}
+		log.Warn(err)
+		err = nil
+	}
+
+	if minutes, offsetErr := cookie.Offset(r); offsetErr == nil {
+		loc = time.FixedZone(offsetName(minutes), minutes*60)
+		return
+	}
+
+	loc = time.Local
+	return
+}
+
+// Returns name such as UTC+05:30 for offset in minutes east of UTC.
+func offsetName(minutes int) string {
+	sign := '+'
+	if minutes < 0 {
+		sign = '-'
+		minutes = -minutes
+	}
+	return fmt.Sprintf("UTC%c%02d:%02d", sign, minutes/60, minutes%60)
+}
+
+// Returns IANA name of t's location when known, and the zone
+// abbreviation, e.g. PST, otherwise.
+func zoneName(t time.Time) string {
+	if name := t.Location().String(); name != "Local" {
+		return name
+	}
+	abbreviation, _ := t.Zone()
+	return abbreviation
+}
+
+// Returns saved preferences of user making request. Zero value is
+// returned for anonymous users or if lookup fails, so that the time
+// page can still be rendered. Preferences are cached alongside names
+// and expire with them.
+func getPrefs(r *http.Request) (prefs people.Prefs) {
+	uuid, err := cookie.UUID(r)
+	if err != nil {
+		return
+	}
+
+	value, state := savedPrefs.Get(uuid)
+	switch state {
+	case cache.STALE:
+		if savedPrefs.Claim(uuid) {
+			go refreshPrefs(uuid)
+		}
+	case cache.MISS:
+		if prefs, err = lookupPrefs(r.Context(), uuid); err != nil {
+			log.Warn(err)
+			return
+		}
+		cachePrefs(uuid, prefs)
+		return
+	}
+	if err = json.Unmarshal([]byte(value), &prefs); err != nil {
+		log.Warn(err)
+	}
+	return
+}
+
+// Asks authserver for preferences of user with uuid.
+func lookupPrefs(ctx context.Context, uuid string) (prefs people.Prefs, err error) {
+	start := time.Now()
+	prefs, err = authClient.PrefsContext(ctx, uuid)
+	authLatency.With("prefs").ObserveSince(start)
+	return
+}
+
+// Replaces stale cached preferences of user with uuid, keeping them
+// if authserver can't be reached.
+func refreshPrefs(uuid string) {
+	ctx, cancel := context.WithTimeout(context.Background(), *config.AuthTimeoutMS)
+	defer cancel()
+	prefs, err := lookupPrefs(ctx, uuid)
+	if err != nil {
+		log.Warn(err)
+		savedPrefs.Release(uuid)
+		return
+	}
+	cachePrefs(uuid, prefs)
+}
+
+// Caches prefs of user with uuid as JSON, which is never empty and
+// so never treated as a negative lookup.
+func cachePrefs(uuid string, prefs people.Prefs) {
+	encoded, err := json.Marshal(prefs)
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+	savedPrefs.Set(uuid, string(encoded))
+}